@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"strings"
+	"github.com/edjohnso/software-engineering-metric-visualisation/pkg/webserver"
+)
+
+// Exit codes, so scripts can tell users who aren't connected from lookups which failed or ran out of requests
+const (
+	exitFound = 0
+	exitNotFound = 1
+	exitError = 2
+	exitBudgetSpent = 3 // Whether the users are connected is unknown
+)
+
+func main() {
+	defaults := webserver.DefaultConfig()
+	query := webserver.PathQuery { Token: os.Getenv("GHO_PAT"), Cache: defaults.Cache, APIURL: defaults.APIURL }
+	if cache := os.Getenv("GHO_CACHE"); cache != "" { query.Cache = cache }
+	if apiURL := os.Getenv("GHO_API_URL"); apiURL != "" { query.APIURL = apiURL }
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flags.StringVar(&query.Cache, "cache", query.Cache, "Cache file shared with the server (env GHO_CACHE)")
+	flags.StringVar(&query.APIURL, "api-url", query.APIURL, "GitHub API root (env GHO_API_URL)")
+	flags.IntVar(&query.MaxDepth, "max-depth", 6, "Longest path searched for, 0 is unlimited")
+	flags.Uint64Var(&query.MaxRequests, "max-requests", 0, "Most GitHub requests sent, 0 is unlimited")
+	flags.BoolVar(&query.Offline, "offline", false, "Only use the cache, sending no requests")
+	verbose := flags.Bool("verbose", false, "Log the search to stderr")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [flags] <source login> <target login>\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Prints the Torvalds Number of two GitHub users and the path of collaborators between them.\n")
+		fmt.Fprintf(flags.Output(), "GitHub is queried with the personal access token in GHO_PAT.\n")
+		fmt.Fprintf(flags.Output(), "Exits with %d if a path was found, %d if not, %d on errors and %d if --max-requests ran out first.\n\n", exitFound, exitNotFound, exitError, exitBudgetSpent)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) { os.Exit(exitFound) }
+		os.Exit(exitError)
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(exitError)
+	}
+	query.Source, query.Target = flags.Arg(0), flags.Arg(1)
+
+	log.SetOutput(io.Discard)
+	if *verbose { log.SetOutput(os.Stderr) }
+
+	answer, err := webserver.FindPath(query)
+	if errors.Is(err, webserver.ErrRequestBudget) {
+		fmt.Printf("No path from %s to %s found within %d requests, there may still be one\n", query.Source, query.Target, answer.Requests)
+		os.Exit(exitBudgetSpent)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitError)
+	}
+	if answer.Distance < 0 {
+		fmt.Printf("No path from %s to %s found (%d requests)\n", query.Source, query.Target, answer.Requests)
+		os.Exit(exitNotFound)
+	}
+	fmt.Printf("Torvalds Number: %d (%d requests)\n", answer.Distance, answer.Requests)
+	fmt.Println(strings.Join(answer.Path, " -> "))
+}
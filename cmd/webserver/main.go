@@ -3,15 +3,16 @@ package main
 import (
 	"os"
 	"fmt"
+	"errors"
+	"flag"
 	"github.com/edjohnso/software-engineering-metric-visualisation/pkg/webserver"
 )
 
 func main() {
-	if len(os.Args) < 5 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <port> <public> <templates> <cache>\n", os.Args[0])
-		os.Exit(1)
-	}
-	if err := webserver.Start(":" + os.Args[1], os.Args[2], os.Args[3], os.Args[4]); err != nil {
+	config, err := webserver.LoadConfig(os.Args[0], os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) { os.Exit(0) }
+	if err == nil { err = webserver.Start(config) }
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
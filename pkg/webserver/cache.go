@@ -1,57 +1,323 @@
 package webserver
 
 import (
-	"log"
 	"os"
+	"fmt"
+	"time"
 	"errors"
+	"strings"
+	"path/filepath"
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"compress/gzip"
 	"encoding/gob"
 )
 
 type diskCacheFormat struct {
-	Requests map[string]requestCacheEntry
-	CollabGraph map[string]userEntry
+	Requests map[string]requestCacheEntry // Up to version 1
+	CollabGraph map[string]userEntry // Up to version 1
+	Salt []byte // Salt of the token hashes in request keys, missing from caches keyed by raw tokens. Up to version 1
+	Buckets map[string]map[string][]byte // Gob encoded values of each Store bucket, from version 2
 }
 
-func readCacheFromDisk(file string) (map[string]requestCacheEntry, map[string]userEntry, error) {
+// Cache files start with the magic header followed by their format version as a big-endian uint32,
+// then the gzip compressed gob of diskCacheFormat. Files from before versioning have no header and are version 0.
+const cacheMagic = "torvalds-cache\n"
+const cacheVersion = 2
+
+// Upgrades a cache decoded from version v to version v+1, keyed by v.
+// Gob ignores fields that were removed and leaves fields that were added empty, so older caches still decode into
+// diskCacheFormat. A change gob can't bridge, such as changing a fields type, needs the old layout decoded here instead.
+var cacheMigrations = map[int]func(srv *server, cache *diskCacheFormat) error {
+
+	// Version 0 caches keyed requests under raw auth tokens until they were given a salt
+	0: func(srv *server, cache *diskCacheFormat) error {
+		if cache.Salt == nil { cache.Requests = srv.rekeyLegacyRequests(cache.Requests) }
+		return nil
+	},
+
+	// Version 1 caches held the request cache and collaboration graph directly rather than in Store buckets
+	1: func(srv *server, cache *diskCacheFormat) error {
+		cache.Buckets = map[string]map[string][]byte { requestsBucket: {}, usersBucket: {}, metaBucket: {} }
+		for key, entry := range cache.Requests {
+			value, err := encodeValue(entry)
+			if err != nil { return err }
+			cache.Buckets[requestsBucket][key] = value
+		}
+		for username, entry := range cache.CollabGraph {
+			value, err := encodeValue(entry)
+			if err != nil { return err }
+			cache.Buckets[usersBucket][username] = value
+		}
+		if cache.Salt != nil { cache.Buckets[metaBucket]["salt"] = cache.Salt }
+		cache.Requests, cache.CollabGraph, cache.Salt = nil, nil, nil
+		return nil
+	},
+}
+
+// Returned when the cache file exists but can't be decoded, e.g. after a crash part way through writing it
+var errCorruptCache = errors.New("Corrupt cache file")
+
+// Reads the cache and the format version it was written in
+func readCacheFromDisk(file string) (diskCacheFormat, int, error) {
+	cache := diskCacheFormat { Requests: map[string]requestCacheEntry{}, CollabGraph: map[string]userEntry{} }
 
 	// Open file to read
 	f, err := os.Open(file)
 	if errors.Is(err, os.ErrNotExist) {
-		log.Printf("Cache not found, loaded no data.")
-		return map[string]requestCacheEntry{}, map[string]userEntry{}, nil
+		infof("Cache not found, loaded no data.")
+		return cache, cacheVersion, nil
 	}
-	if err != nil { return nil, nil, err }
+	if err != nil { return cache, 0, err }
 	defer f.Close()
 
+	// Read the header, if there is one
+	r := bufio.NewReader(f)
+	version := 0
+	if header, err := r.Peek(len(cacheMagic)); err == nil && string(header) == cacheMagic {
+		r.Discard(len(cacheMagic))
+		var v uint32
+		if err := binary.Read(r, binary.BigEndian, &v); err != nil { return cache, 0, fmt.Errorf("%w: %v", errCorruptCache, err) }
+		version = int(v)
+	}
+	if version > cacheVersion { return cache, version, fmt.Errorf("Cache format version %d is newer than this server supports (%d)", version, cacheVersion) }
+
 	// Use GZip decompression
-	z, err := gzip.NewReader(f)
-	if err != nil { return nil, nil, err }
+	z, err := gzip.NewReader(r)
+	if err != nil { return cache, version, fmt.Errorf("%w: %v", errCorruptCache, err) }
 	defer z.Close()
 
 	// Decompress and decode file to cache
-	var cache diskCacheFormat
 	err = gob.NewDecoder(z).Decode(&cache)
-	if err != nil { return nil, nil, err }
+	if err != nil { return cache, version, fmt.Errorf("%w: %v", errCorruptCache, err) }
 
-	return cache.Requests, cache.CollabGraph, nil
+	// Gob leaves out empty maps
+	if cache.Requests == nil { cache.Requests = map[string]requestCacheEntry{} }
+	if cache.CollabGraph == nil { cache.CollabGraph = map[string]userEntry{} }
+
+	return cache, version, nil
 }
 
-func writeCacheToDisk(file string, requests map[string]requestCacheEntry, collabGraph map[string]userEntry) error {
+// Writes the cache to a temporary file beside the cache file and renames it over the cache file once it is synced,
+// so a crash part way through never leaves a partially written cache behind
+func writeCacheToDisk(file string, cache diskCacheFormat) error {
 
-	// Create file to write to
-	f, err := os.Create(file)
+	// Create temporary file to write to
+	dir := filepath.Dir(file)
+	f, err := os.CreateTemp(dir, filepath.Base(file) + ".tmp-*")
 	if err != nil { return err }
+	defer os.Remove(f.Name()) // Fails harmlessly once renamed
 	defer f.Close()
 
-	// Use GZip compression
+	// Write the header, then encode and compress cache to file with GZip compression
+	if _, err := f.WriteString(cacheMagic); err != nil { return err }
+	if err := binary.Write(f, binary.BigEndian, uint32(cacheVersion)); err != nil { return err }
 	z := gzip.NewWriter(f)
-	defer z.Close()
+	if err := gob.NewEncoder(z).Encode(cache); err != nil { return err }
+	if err := z.Close(); err != nil { return err }
+
+	// Make sure the data is on disk before replacing the old cache with it
+	if err := f.Sync(); err != nil { return err }
+	if err := f.Close(); err != nil { return err }
+	if err := os.Rename(f.Name(), file); err != nil { return err }
+
+	// Persist the rename itself, not possible on every platform
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Upgrades a cache decoded from the given format version to the current version
+func (srv *server) migrateCache(cache *diskCacheFormat, version int) error {
+	for ; version < cacheVersion; version++ {
+		infof("Upgrading cache from format version %d to %d...", version, version + 1)
+		if err := cacheMigrations[version](srv, cache); err != nil { return err }
+	}
+	return nil
+}
+
+func encodeValue(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func decodeValue(value []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(value)).Decode(v)
+}
+
+// Opens the store for the cache file and loads the request cache, collaboration graph and crawls from it.
+// A corrupt cache is moved aside for inspection and the server starts with an empty cache. Offline servers leave the
+// cache file as it is, failing on a corrupt cache instead.
+func (srv *server) loadCache(file string) error {
+	store, err := srv.openStore(file)
+	if errors.Is(err, errCorruptCache) && !srv.offline {
+		quarantine := file + ".corrupt-" + time.Now().Format("20060102T150405")
+		warnf("%v, moving it to %s and starting with an empty cache.", err, quarantine)
+		if err := os.Rename(file, quarantine); err != nil { return err }
+		store, err = srv.openStore(file)
+	}
+	if err != nil { return err }
+
+	requests := map[string]requestCacheEntry{}
+	err = store.Iterate(requestsBucket, func(key string, value []byte) error {
+		var entry requestCacheEntry
+		if err := decodeValue(value, &entry); err != nil { return fmt.Errorf("Request %s: %w", key, err) }
+		requests[key] = entry
+		return nil
+	})
+	if err != nil { return err }
+
+	collabGraph := map[string]userEntry{}
+	err = store.Iterate(usersBucket, func(username string, value []byte) error {
+		var entry userEntry
+		if err := decodeValue(value, &entry); err != nil { return fmt.Errorf("User %s: %w", username, err) }
+		collabGraph[username] = entry
+		return nil
+	})
+	if err != nil { return err }
 
-	// Encode and compress cache to file
-	cache := diskCacheFormat { requests, collabGraph }
-	err = gob.NewEncoder(z).Encode(cache)
+	prefs := map[string]crawlPrefs{}
+	err = store.Iterate(prefsBucket, func(login string, value []byte) error {
+		var entry crawlPrefs
+		if err := decodeValue(value, &entry); err != nil { return fmt.Errorf("Preferences of %s: %w", login, err) }
+		prefs[login] = entry
+		return nil
+	})
 	if err != nil { return err }
 
+	frontiers := map[string]*crawlFrontier{}
+	err = store.Iterate(frontierBucket, func(root string, value []byte) error {
+		var frontier crawlFrontier
+		if err := decodeValue(value, &frontier); err != nil { return fmt.Errorf("Crawl frontier of %s: %w", root, err) }
+		frontiers[root] = &frontier
+		return nil
+	})
+	if err != nil { return err }
+
+	salt, ok, err := store.Get(metaBucket, "salt")
+	if err != nil { return err }
+	if !ok && !srv.offline { err = store.Put(metaBucket, "salt", srv.cacheSalt) }
+	if err != nil { return err }
+
+	if srv.store != nil { srv.store.Close() }
+	srv.store, srv.requestCache, srv.collabGraph = store, requests, collabGraph
+	srv.prefs, srv.frontiers = prefs, frontiers
+	if ok { srv.cacheSalt = salt }
+	srv.dirtyRequests, srv.dirtyUsers = map[string]bool{}, map[string]bool{}
+	srv.dirtyPrefs, srv.dirtyFrontiers = map[string]bool{}, map[string]bool{}
+	srv.resetRequestLRU(srv.now())
 	return nil
 }
+
+// Writes the requests, users, preferences and crawl frontiers changed since the last save to the store and flushes it.
+// Returns the number of requests and users in the cache.
+func (srv *server) saveCache() (int, int, error) {
+
+	// Take the changes under the locks guarding them, entries are never modified once added, only replaced
+	changes := map[string]map[string]interface{}{}
+	srv.requestMutex.Lock()
+	srv.evictExpiredRequests(srv.now())
+	changes[requestsBucket] = takeChanges(srv.dirtyRequests, func(key string) (interface{}, bool) {
+		entry, ok := srv.requestCache[key]
+		return entry, ok
+	})
+	srv.dirtyRequests = map[string]bool{}
+	requestCount := len(srv.requestCache)
+	srv.requestMutex.Unlock()
+
+	srv.graphMutex.Lock()
+	changes[usersBucket] = takeChanges(srv.dirtyUsers, func(username string) (interface{}, bool) {
+		entry, ok := srv.collabGraph[username]
+		return entry, ok
+	})
+	srv.dirtyUsers = map[string]bool{}
+	userCount := len(srv.collabGraph)
+	srv.graphMutex.Unlock()
+
+	srv.prefsMutex.Lock()
+	changes[prefsBucket] = takeChanges(srv.dirtyPrefs, func(login string) (interface{}, bool) {
+		prefs, ok := srv.prefs[login]
+		return prefs, ok
+	})
+	srv.dirtyPrefs = map[string]bool{}
+	srv.prefsMutex.Unlock()
+
+	// Crawls change their frontiers in place, so only copy them here
+	srv.frontierMutex.Lock()
+	changes[frontierBucket] = takeChanges(srv.dirtyFrontiers, func(root string) (interface{}, bool) {
+		frontier, ok := srv.frontiers[root]
+		if !ok { return nil, false }
+		return frontier.copy(), true
+	})
+	srv.dirtyFrontiers = map[string]bool{}
+	srv.frontierMutex.Unlock()
+
+	err := srv.storeChanges(changes)
+	if err == nil { err = srv.store.Flush() }
+	if err != nil {
+
+		// Try again next time
+		srv.requestMutex.Lock()
+		markDirty(srv.dirtyRequests, changes[requestsBucket])
+		srv.requestMutex.Unlock()
+		srv.graphMutex.Lock()
+		markDirty(srv.dirtyUsers, changes[usersBucket])
+		srv.graphMutex.Unlock()
+		srv.prefsMutex.Lock()
+		markDirty(srv.dirtyPrefs, changes[prefsBucket])
+		srv.prefsMutex.Unlock()
+		srv.frontierMutex.Lock()
+		markDirty(srv.dirtyFrontiers, changes[frontierBucket])
+		srv.frontierMutex.Unlock()
+	}
+	return requestCount, userCount, err
+}
+
+// Looks up the current value of each dirty key, nil for those which have been removed
+func takeChanges(dirty map[string]bool, lookup func(key string) (interface{}, bool)) map[string]interface{} {
+	changes := make(map[string]interface{}, len(dirty))
+	for key := range dirty {
+		if value, ok := lookup(key); ok { changes[key] = value } else { changes[key] = nil }
+	}
+	return changes
+}
+
+func markDirty(dirty map[string]bool, changes map[string]interface{}) {
+	for key := range changes { dirty[key] = true }
+}
+
+// Puts the changed values of each bucket in the store, deleting those which are nil
+func (srv *server) storeChanges(changes map[string]map[string]interface{}) error {
+	for bucket, values := range changes {
+		for key, value := range values {
+			if err := srv.storeValue(bucket, key, value, value == nil); err != nil { return err }
+		}
+	}
+	return nil
+}
+
+func (srv *server) storeValue(bucket, key string, v interface{}, deleted bool) error {
+	if deleted { return srv.store.Delete(bucket, key) }
+	value, err := encodeValue(v)
+	if err != nil { return err }
+	return srv.store.Put(bucket, key, value)
+}
+
+// Older caches keyed requests as "<token>:<method>:<url>".
+// Public responses are kept under their token-independent key, the rest are dropped.
+func (srv *server) rekeyLegacyRequests(legacy map[string]requestCacheEntry) map[string]requestCacheEntry {
+	requests := map[string]requestCacheEntry{}
+	for key, entry := range legacy {
+		parts := strings.SplitN(key, ":", 3)
+		if len(parts) != 3 { continue }
+		if newKey := srv.cacheKey("", parts[1], parts[2]); newKey != "" && (parts[0] == "" || srv.isPublicURL(parts[2])) {
+			requests[newKey] = entry
+		}
+	}
+	infof("Rekeyed %d of %d requests cached under auth tokens.", len(requests), len(legacy))
+	return requests
+}
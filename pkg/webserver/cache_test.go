@@ -5,6 +5,13 @@ import (
 	"os"
 	"path/filepath"
 	"time"
+	"fmt"
+	"sync"
+	"errors"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
 )
 
 func TestReadCacheFromDisk(t *testing.T) {
@@ -21,14 +28,22 @@ func TestReadCacheFromDisk(t *testing.T) {
 	requests := map[string]requestCacheEntry{}
 	requests["testrequest"] = requestCacheEntry { time.Now(), "xyz", response { 200, nil, []byte("testresponse") } }
 	collabGraph := map[string]userEntry{}
-	collabGraph["testuser"] = userEntry { 0, []string { "testcollaborator" } }
+	collabGraph["testuser"] = userEntry { []string { "testcollaborator" }, map[string][]repoLink { "testcollaborator": { { "testuser/testrepo", 42 } } }, time.Time{} }
 
-	if err := writeCacheToDisk(file, requests, collabGraph); err != nil {
+	salt := []byte("testsalt")
+	if err := writeCacheToDisk(file, diskCacheFormat { Requests: requests, CollabGraph: collabGraph, Salt: salt }); err != nil {
 		t.Fatalf("Unable to write test cache file %s: %v", file, err)
 	}
-	if requestsCached, collabGraphCached, err := readCacheFromDisk(file); err != nil {
+	if cache, version, err := readCacheFromDisk(file); err != nil {
 		t.Errorf("Expected no error, actually received: %v", err)
 	} else {
+		requestsCached, collabGraphCached := cache.Requests, cache.CollabGraph
+		if version != cacheVersion {
+			t.Errorf("Expected version: %d - Actual version: %d", cacheVersion, version)
+		}
+		if string(cache.Salt) != string(salt) {
+			t.Errorf("Expected salt: %s - Actual salt: %s", salt, cache.Salt)
+		}
 		if len(requestsCached) != len(requests) {
 			t.Errorf("Cached requests contains %d entries but %d were expected", len(requestsCached), len(requests))
 		}
@@ -53,9 +68,6 @@ func TestReadCacheFromDisk(t *testing.T) {
 			if cachedEntry, ok := collabGraphCached[user]; !ok {
 				t.Errorf("Cached collab graph missing %s", user)
 			} else {
-				if entry.RequestedDepth != cachedEntry.RequestedDepth {
-					t.Errorf("Expected depth: %d - Actual depth: %d", entry.RequestedDepth, cachedEntry.RequestedDepth)
-				}
 				match := len(entry.Collaborators) == len(cachedEntry.Collaborators)
 				for i := range entry.Collaborators {
 					if match && cachedEntry.Collaborators[i] != entry.Collaborators[i] {
@@ -67,6 +79,9 @@ func TestReadCacheFromDisk(t *testing.T) {
 						"Expected collaborators do not match. Expected: %v. Actual: %v",
 						entry.Collaborators, cachedEntry.Collaborators)
 				}
+				if fmt.Sprint(entry.Repos) != fmt.Sprint(cachedEntry.Repos) {
+					t.Errorf("Expected repos: %v - Actual repos: %v", entry.Repos, cachedEntry.Repos)
+				}
 			}
 		}
 	}
@@ -79,12 +94,183 @@ func TestWriteCacheToDisk(t *testing.T) {
 	requests := map[string]requestCacheEntry{}
 	requests["testrequest"] = requestCacheEntry { time.Now(), "xyz", response { 200, nil, []byte("testresponse") } }
 	collabGraph := map[string]userEntry{}
-	collabGraph["testuser"] = userEntry { 0, []string { "testcollaborator" } }
+	collabGraph["testuser"] = userEntry { []string { "testcollaborator" }, map[string][]repoLink { "testcollaborator": { { "testuser/testrepo", 42 } } }, time.Time{} }
 
-	if err := writeCacheToDisk(file, requests, collabGraph); err != nil {
+	if err := writeCacheToDisk(file, diskCacheFormat { Requests: requests, CollabGraph: collabGraph }); err != nil {
 		t.Errorf("Unable to write cache file %s: %v", file, err)
 	}
 	if _, err := os.Stat(file); err != nil {
 		t.Errorf("Unable to access new cache file %s: %v", file, err)
 	}
+
+	// Rewriting replaces the cache without leaving temporary files behind
+	if err := writeCacheToDisk(file, diskCacheFormat { Requests: requests, CollabGraph: collabGraph }); err != nil {
+		t.Errorf("Unable to rewrite cache file %s: %v", file, err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("Expected only the cache file in %s, actually found %v (%v)", dir, entries, err)
+	}
+}
+
+func TestLoadCorruptCache(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+	dir := t.TempDir()
+	file := filepath.Join(dir, "cache.gz")
+
+	if err := os.WriteFile(file, []byte("truncated"), os.ModePerm); err != nil {
+		t.Fatalf("Unable to create %s file: %v", file, err)
+	}
+	if err := srv.loadCache(file); err != nil {
+		t.Fatalf("Expected corrupt cache to be quarantined, actually received: %v", err)
+	}
+	if len(srv.requestCache) != 0 || len(srv.collabGraph) != 0 {
+		t.Errorf("Expected empty cache after quarantine")
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("Expected corrupt cache to be moved away from %s", file)
+	}
+	if quarantined, _ := filepath.Glob(file + ".corrupt-*"); len(quarantined) != 1 {
+		t.Errorf("Expected 1 quarantined cache file, actually found: %v", quarantined)
+	}
+}
+
+func TestSaveCacheConcurrently(t *testing.T) {
+	testAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer testAPIServer.Close()
+
+	for _, name := range []string { "cache.gz", "cache.log" } {
+		t.Run(name, func(t *testing.T) {
+			srv, err := setupTestServer()
+			if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+			file := filepath.Join(t.TempDir(), name)
+			if err := srv.loadCache(file); err != nil { t.Fatalf("Unable to load cache: %v", err) }
+
+			// Changes are saved while requests are cached and users are scanned
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					srv.request("", http.MethodGet, fmt.Sprintf("%s/%d", testAPIServer.URL, i))
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					srv.updateUser(fmt.Sprint(i), func(entry *userEntry) { entry.Collaborators = []string { "foo" } })
+				}
+			}()
+			for i := 0; i < 10; i++ {
+				if _, _, err := srv.saveCache(); err != nil { t.Errorf("Unable to save cache: %v", err) }
+			}
+			wg.Wait()
+
+			requests, users, err := srv.saveCache()
+			if err != nil || requests != 50 || users != 50 {
+				t.Errorf("Expected 50 requests and 50 users saved, actually saved %d and %d (%v)", requests, users, err)
+			}
+			if err := srv.store.Close(); err != nil { t.Fatalf("Unable to close store: %v", err) }
+
+			loaded, err := setupTestServer()
+			if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+			if err := loaded.loadCache(file); err != nil { t.Fatalf("Unable to load cache: %v", err) }
+			defer loaded.store.Close()
+			if len(loaded.requestCache) != 50 || len(loaded.collabGraph) != 50 {
+				t.Errorf("Expected 50 requests and 50 users loaded, actually loaded %d and %d", len(loaded.requestCache), len(loaded.collabGraph))
+			}
+			if string(loaded.cacheSalt) != string(srv.cacheSalt) {
+				t.Errorf("Expected salt to be saved with the cache")
+			}
+		})
+	}
+}
+
+// Fixtures in testdata were written by each historical version of the cache format
+func TestCacheFixtures(t *testing.T) {
+	salt := []byte("fixturesalt")
+	hash := sha256.Sum256(append(append([]byte{}, salt...), "gho_fixture"...))
+	api := "https://api.github.com"
+
+	testCases := []struct { name string; file string; version int; requests []string; repos bool; salt []byte } {
+		{
+			"Version 0", "cache-v0.gz", 0,
+			[]string { "GET:" + api + "/users/bob", "GET:" + api + "/users/alice/repos" },
+			false, nil,
+		},
+		{
+			"Version 0 with salt", "cache-v0-salted.gz", 0,
+			[]string { hex.EncodeToString(hash[:]) + ":GET:" + api + "/user", "GET:" + api + "/users/bob", "GET:" + api + "/users/alice/repos?per_page=100" },
+			true, salt,
+		},
+		{
+			"Version 1", "cache-v1.gz", 1,
+			[]string { hex.EncodeToString(hash[:]) + ":GET:" + api + "/user", "GET:" + api + "/users/bob", "GET:" + api + "/users/alice/repos?per_page=100" },
+			true, salt,
+		},
+		{
+			"Version 2", "cache-v2.gz", 2,
+			[]string { hex.EncodeToString(hash[:]) + ":GET:" + api + "/user", "GET:" + api + "/users/bob", "GET:" + api + "/users/alice/repos?per_page=100" },
+			true, salt,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			file := filepath.Join("testdata", testCase.file)
+			if _, version, err := readCacheFromDisk(file); err != nil || version != testCase.version {
+				t.Errorf("Expected version: %d - Actual version: %d (%v)", testCase.version, version, err)
+			}
+
+			// The store isn't closed so the upgraded cache is never written over the fixture
+			srv, err := setupTestServer()
+			if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+			newSalt := srv.cacheSalt
+			if err := srv.loadCache(file); err != nil { t.Fatalf("Unable to load cache: %v", err) }
+
+			// Tokens are never kept and responses survive the upgrade
+			if len(srv.requestCache) != len(testCase.requests) {
+				t.Errorf("Expected requests: %v - Actual requests: %v", testCase.requests, srv.requestCache)
+			}
+			for _, key := range testCase.requests {
+				if entry, ok := srv.requestCache[key]; !ok {
+					t.Errorf("Cached requests missing %s", key)
+				} else if entry.ETag != "etag" || entry.Response.Status != http.StatusOK || entry.Response.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("Cached request %s not decoded: %v", key, entry)
+				}
+			}
+			if testCase.salt == nil { testCase.salt = newSalt }
+			if string(srv.cacheSalt) != string(testCase.salt) {
+				t.Errorf("Expected salt: %x - Actual salt: %x", testCase.salt, srv.cacheSalt)
+			}
+
+			alice := srv.collabGraph["alice"]
+			if fmt.Sprint(alice.Collaborators) != "[bob]" {
+				t.Errorf("Expected alice with collaborator bob, actually loaded: %v", alice)
+			}
+			if expected := "map[bob:[{alice/foo 3}]]"; testCase.repos && fmt.Sprint(alice.Repos) != expected {
+				t.Errorf("Expected repos: %s - Actual repos: %v", expected, alice.Repos)
+			}
+			if _, ok := srv.collabGraph["bob"]; !ok { t.Errorf("Cached collab graph missing bob") }
+		})
+	}
+}
+
+func TestCacheNewerVersion(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache.gz")
+	if err := os.WriteFile(file, append([]byte(cacheMagic), 0, 0, 0, cacheVersion + 1), os.ModePerm); err != nil {
+		t.Fatalf("Unable to create %s file: %v", file, err)
+	}
+
+	// Caches from newer servers are left alone rather than quarantined
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+	if err := srv.loadCache(file); err == nil || errors.Is(err, errCorruptCache) {
+		t.Errorf("Expected error when loading a newer cache format, actually received: %v", err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("Expected newer cache to be left in place: %v", err)
+	}
 }
@@ -0,0 +1,288 @@
+package webserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Settings of the server. Each is read from, in increasing precedence, its default, the JSON config file, its GHO_*
+// environment variable and its command-line flag.
+type Config struct {
+	Listen string // Address to listen on, e.g. ":80" or "127.0.0.1:8080"
+	Public string // Directory of static files
+	Templates string // Pattern matching the HTML templates
+	Cache string // Cache file, kept in an append-only log if it ends in .log
+	Autosave time.Duration // How often the cache is saved
+	ShutdownTimeout time.Duration // How long shutdown waits for crawls to stop before the final cache write
+	TLSCert string // Certificate and key files, the server speaks plain HTTP without them
+	TLSKey string
+	HTTPSRedirect string // Address to redirect plain HTTP to HTTPS from, e.g. ":80"
+	HSTS time.Duration // Strict-Transport-Security max-age sent over HTTPS, 0 sends none
+	APIURL string
+	OAuthURL string
+	Workers int // Number of GitHub requests sent concurrently
+	ClientID string
+	ClientSecret string
+	SessionKey string // Base64 encoded 32 byte key encrypting the access tokens of sessions
+	CacheMaxEntries int // Request cache limits, 0 is unlimited
+	CacheMaxBytes int64
+	CacheMaxAge time.Duration
+	CacheTTLs string // Overrides of the default TTLs, e.g. "/users/{user}=72h,default=12h"
+	CacheHonourMaxAge bool
+	ExpandTTL time.Duration // How long scanned collaborators are reused before the user is scanned again
+	Crawlers int // Number of background crawls run at once
+	CrawlTokens string // Comma separated personal access tokens background crawls use instead of their subscribers
+	AppID int64 // GitHub App whose installation tokens background crawls use too, 0 for none
+	AppInstallation int64
+	AppKey string // Private key file of the GitHub App
+	Seeds string // File listing the logins to crawl from in the background at startup, one per line
+	SeedDepth int
+	LogLevel string
+}
+
+// Log levels, each showing less than the last
+const (
+	logInfo = "info"
+	logWarning = "warning"
+	logSilent = "silent"
+)
+
+func DefaultConfig() Config {
+	return Config {
+		Listen: ":80",
+		Public: "./web/public",
+		Templates: "./web/templates/*.html",
+		Cache: "cache.gz",
+		Autosave: 30 * time.Second,
+		ShutdownTimeout: defaultShutdownTimeout,
+		APIURL: defaultAPIURL,
+		OAuthURL: defaultOAuthURL,
+		Workers: defaultWorkers,
+		ExpandTTL: defaultExpandTTL,
+		Crawlers: defaultCrawlers,
+		SeedDepth: defaultSeedDepth,
+		LogLevel: logInfo,
+	}
+}
+
+// A setting, named the same by its flag and config file key
+type configOption struct {
+	name string
+	env string
+	usage string
+	secret bool // Kept out of flags, where it would show up in the process list and shell history
+	field func(c *Config) interface{} // Points to the setting within the config
+}
+
+var configOptions = []configOption {
+	{ "listen", "GHO_LISTEN", "Address to listen on", false, func(c *Config) interface{} { return &c.Listen } },
+	{ "public", "GHO_PUBLIC", "Directory of static files", false, func(c *Config) interface{} { return &c.Public } },
+	{ "templates", "GHO_TEMPLATES", "Pattern matching the HTML templates", false, func(c *Config) interface{} { return &c.Templates } },
+	{ "cache", "GHO_CACHE", "Cache file, an append-only log if it ends in .log", false, func(c *Config) interface{} { return &c.Cache } },
+	{ "autosave", "GHO_AUTOSAVE", "How often the cache is saved", false, func(c *Config) interface{} { return &c.Autosave } },
+	{ "shutdown-timeout", "GHO_SHUTDOWN_TIMEOUT", "How long shutdown waits for crawls to stop before the final cache save", false, func(c *Config) interface{} { return &c.ShutdownTimeout } },
+	{ "tls-cert", "GHO_TLS_CERT", "TLS certificate file, serves HTTPS with tls-key", false, func(c *Config) interface{} { return &c.TLSCert } },
+	{ "tls-key", "GHO_TLS_KEY", "TLS private key file", false, func(c *Config) interface{} { return &c.TLSKey } },
+	{ "https-redirect", "GHO_HTTPS_REDIRECT", "Address to redirect plain HTTP to HTTPS from, e.g. :80", false, func(c *Config) interface{} { return &c.HTTPSRedirect } },
+	{ "hsts", "GHO_HSTS", "Strict-Transport-Security max-age sent over HTTPS, e.g. 8760h", false, func(c *Config) interface{} { return &c.HSTS } },
+	{ "api-url", "GHO_API_URL", "GitHub API root", false, func(c *Config) interface{} { return &c.APIURL } },
+	{ "oauth-url", "GHO_OAUTH_URL", "GitHub web root for OAuth", false, func(c *Config) interface{} { return &c.OAuthURL } },
+	{ "workers", "GHO_WORKERS", "Number of GitHub requests sent concurrently", false, func(c *Config) interface{} { return &c.Workers } },
+	{ "client-id", "GHO_CLIENT_ID", "GitHub OAuth App client ID", false, func(c *Config) interface{} { return &c.ClientID } },
+	{ "client-secret", "GHO_CLIENT_SECRET", "GitHub OAuth App client secret", true, func(c *Config) interface{} { return &c.ClientSecret } },
+	{ "session-key", "GHO_SESSION_KEY", "Base64 encoded 32 byte key encrypting the access tokens of sessions", true, func(c *Config) interface{} { return &c.SessionKey } },
+	{ "cache-max-entries", "GHO_CACHE_MAX_ENTRIES", "Most requests cached, 0 is unlimited", false, func(c *Config) interface{} { return &c.CacheMaxEntries } },
+	{ "cache-max-bytes", "GHO_CACHE_MAX_BYTES", "Most bytes of requests cached, 0 is unlimited", false, func(c *Config) interface{} { return &c.CacheMaxBytes } },
+	{ "cache-max-age", "GHO_CACHE_MAX_AGE", "Oldest request cached, 0 is unlimited", false, func(c *Config) interface{} { return &c.CacheMaxAge } },
+	{ "cache-ttls", "GHO_CACHE_TTLS", "Revalidation TTLs as pattern=duration,..., e.g. /users/{user}=72h,default=12h", false, func(c *Config) interface{} { return &c.CacheTTLs } },
+	{ "cache-honour-max-age", "GHO_CACHE_HONOUR_MAX_AGE", "Revalidate after the max-age GitHub sends instead", false, func(c *Config) interface{} { return &c.CacheHonourMaxAge } },
+	{ "expand-ttl", "GHO_EXPAND_TTL", "How long scanned collaborators are reused before the user is scanned again", false, func(c *Config) interface{} { return &c.ExpandTTL } },
+	{ "crawlers", "GHO_CRAWLERS", "Number of background crawls run at once", false, func(c *Config) interface{} { return &c.Crawlers } },
+	{ "crawl-tokens", "GHO_CRAWL_TOKENS", "Comma separated personal access tokens background crawls use", true, func(c *Config) interface{} { return &c.CrawlTokens } },
+	{ "app-id", "GHO_APP_ID", "GitHub App whose installation tokens background crawls use", false, func(c *Config) interface{} { return &c.AppID } },
+	{ "app-installation", "GHO_APP_INSTALLATION", "Installation of the GitHub App", false, func(c *Config) interface{} { return &c.AppInstallation } },
+	{ "app-key", "GHO_APP_KEY", "Private key file of the GitHub App", false, func(c *Config) interface{} { return &c.AppKey } },
+	{ "seeds", "GHO_SEEDS", "File listing logins to crawl from in the background at startup, one per line", false, func(c *Config) interface{} { return &c.Seeds } },
+	{ "seed-depth", "GHO_SEED_DEPTH", "Depth seeded logins are crawled to", false, func(c *Config) interface{} { return &c.SeedDepth } },
+	{ "log-level", "GHO_LOG_LEVEL", "One of info, warning or silent", false, func(c *Config) interface{} { return &c.LogLevel } },
+}
+
+// Holds a flags value until the config file and environment have been read, so it can be applied last
+type pendingFlag struct {
+	values map[string]string
+	name string
+	bool bool
+}
+
+func (f pendingFlag) String() string { return "" }
+func (f pendingFlag) IsBoolFlag() bool { return f.bool }
+func (f pendingFlag) Set(value string) error {
+	f.values[f.name] = value
+	return nil
+}
+
+// Reads the config from the command-line arguments, environment variables and the config file named by --config or
+// GHO_CONFIG. The arguments <port> <public> <templates> <cache> of older versions are still accepted.
+// Returns flag.ErrHelp after writing the usage to output if it was asked for.
+func LoadConfig(name string, args []string, output io.Writer) (Config, error) {
+	config := DefaultConfig()
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.Usage = func() { printUsage(output, name) }
+	file := flags.String("config", os.Getenv("GHO_CONFIG"), "")
+	values := map[string]string{}
+	for _, option := range configOptions {
+		if option.secret { continue }
+		_, isBool := option.field(&config).(*bool)
+		flags.Var(pendingFlag { values, option.name, isBool }, option.name, option.usage)
+	}
+	if err := flags.Parse(args); err != nil { return config, err }
+
+	switch flags.NArg() {
+	case 0:
+	case 4:
+		fmt.Fprintf(output, "Warning - Positional arguments are deprecated, use --listen, --public, --templates and --cache instead.\n")
+		positional := []string { "listen", "public", "templates", "cache" }
+		for i, option := range positional {
+			value := flags.Arg(i)
+			if option == "listen" { value = ":" + value }
+			if _, ok := values[option]; !ok { values[option] = value }
+		}
+	default:
+		return config, fmt.Errorf("Unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	if *file != "" {
+		if err := config.readFile(*file); err != nil { return config, err }
+	}
+	for _, option := range configOptions {
+		if value := os.Getenv(option.env); value != "" {
+			if err := setOption(option.field(&config), value); err != nil { return config, fmt.Errorf("Invalid %s value: %s", option.env, value) }
+		}
+	}
+	for _, option := range configOptions {
+		if value, ok := values[option.name]; ok {
+			if err := setOption(option.field(&config), value); err != nil { return config, fmt.Errorf("Invalid --%s value: %s", option.name, value) }
+		}
+	}
+	return config, config.validate()
+}
+
+// Reads settings from a JSON object keyed by option name, e.g. {"listen": ":8080", "workers": 4, "autosave": "1m"}
+func (c *Config) readFile(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil { return err }
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil { return fmt.Errorf("Invalid config file %s: %v", file, err) }
+
+	for key, value := range values {
+		var option *configOption
+		for i := range configOptions {
+			if configOptions[i].name == key { option = &configOptions[i] }
+		}
+		if option == nil { return fmt.Errorf("Unknown setting in %s: %s", file, key) }
+		if err := setOption(option.field(c), fmt.Sprint(value)); err != nil { return fmt.Errorf("Invalid %s value in %s: %v", key, file, value) }
+	}
+	return nil
+}
+
+func setOption(field interface{}, value string) error {
+	var err error
+	switch field := field.(type) {
+	case *string:
+		*field = value
+	case *int:
+		*field, err = strconv.Atoi(value)
+	case *int64:
+		*field, err = strconv.ParseInt(value, 10, 64)
+	case *bool:
+		*field, err = strconv.ParseBool(value)
+	case *time.Duration:
+		*field, err = time.ParseDuration(value)
+	default:
+		panic(fmt.Sprintf("Unsupported setting type %T", field))
+	}
+	return err
+}
+
+func (c Config) validate() error {
+	switch {
+	case c.ClientID == "" || c.ClientSecret == "":
+		return errors.New("Missing client ID or secret, set GHO_CLIENT_ID and GHO_CLIENT_SECRET")
+	case (c.TLSCert == "") != (c.TLSKey == ""):
+		return errors.New("TLS needs both a certificate and a key")
+	case c.HTTPSRedirect != "" && c.TLSCert == "":
+		return errors.New("Redirecting to HTTPS needs a TLS certificate and key")
+	case c.HSTS < 0:
+		return fmt.Errorf("Invalid HSTS max-age: %v", c.HSTS)
+	case c.Autosave <= 0:
+		return fmt.Errorf("Invalid autosave interval: %v", c.Autosave)
+	case c.ShutdownTimeout <= 0:
+		return fmt.Errorf("Invalid shutdown timeout: %v", c.ShutdownTimeout)
+	case c.Workers < 1:
+		return fmt.Errorf("Invalid number of workers: %d", c.Workers)
+	case c.Crawlers < 1:
+		return fmt.Errorf("Invalid number of crawlers: %d", c.Crawlers)
+	case c.SeedDepth < 0:
+		return fmt.Errorf("Invalid seed depth: %d", c.SeedDepth)
+	case c.AppID != 0 && (c.AppInstallation == 0 || c.AppKey == ""):
+		return errors.New("A GitHub App needs an installation and a private key")
+	case c.CacheMaxEntries < 0 || c.CacheMaxBytes < 0 || c.CacheMaxAge < 0 || c.ExpandTTL < 0:
+		return errors.New("Cache limits and TTLs can't be negative")
+	case c.LogLevel != logInfo && c.LogLevel != logWarning && c.LogLevel != logSilent:
+		return fmt.Errorf("Invalid log level: %s", c.LogLevel)
+	}
+	return nil
+}
+
+func printUsage(w io.Writer, name string) {
+	defaults := DefaultConfig()
+	fmt.Fprintf(w, "Usage: %s [flags]\n\n", name)
+	fmt.Fprintf(w, "Each setting is taken from the first of these which sets it:\n")
+	fmt.Fprintf(w, "  1. its command-line flag\n")
+	fmt.Fprintf(w, "  2. its environment variable\n")
+	fmt.Fprintf(w, "  3. its key in the JSON config file named by --config or GHO_CONFIG, e.g. {\"listen\": \":8080\"}\n")
+	fmt.Fprintf(w, "  4. its default\n")
+	fmt.Fprintf(w, "Secrets have no flag, so they stay out of the process list and shell history.\n\n")
+	fmt.Fprintf(w, "  --config file (env GHO_CONFIG)\n    \tJSON config file\n")
+	for _, option := range configOptions {
+		flagName := "--" + option.name
+		if option.secret { flagName = "(no flag)" }
+		fmt.Fprintf(w, "  %s (env %s, key %q)\n    \t%s", flagName, option.env, option.name, option.usage)
+		if value := fmt.Sprint(reflect.ValueOf(option.field(&defaults)).Elem()); value != "" && value != "0" && value != "0s" && value != "false" {
+			fmt.Fprintf(w, " (default %q)", value)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+var logLevels = map[string]int32 { logInfo: 0, logWarning: 1, logSilent: 2 }
+var minLogLevel int32 // Messages below this index in logLevels are dropped, accessed atomically
+
+func setLogLevel(level string) { atomic.StoreInt32(&minLogLevel, logLevels[level]) }
+
+func logAt(level string, format string, args ...interface{}) {
+	if logLevels[level] < atomic.LoadInt32(&minLogLevel) { return }
+	if level == logWarning { format = "Warning - " + format }
+	log.Printf(format, args...)
+}
+
+// Logs progress, shown at the info level
+func infof(format string, args ...interface{}) { logAt(logInfo, format, args...) }
+
+// Logs a failure, shown at the info and warning levels
+func warnf(format string, args ...interface{}) { logAt(logWarning, format, args...) }
@@ -0,0 +1,137 @@
+package webserver
+
+import (
+	"testing"
+	"bytes"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	writeConfigFile := func(t *testing.T, content string) string {
+		file := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil { t.Fatalf("Unable to write config file: %v", err) }
+		return file
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		config, err := LoadConfig("test", nil, &bytes.Buffer{})
+		if err != nil { t.Fatalf("Failed to load config: %v", err) }
+		expected := DefaultConfig()
+		expected.ClientID, expected.ClientSecret = os.Getenv("GHO_CLIENT_ID"), os.Getenv("GHO_CLIENT_SECRET")
+		expected.SessionKey = os.Getenv("GHO_SESSION_KEY")
+		if config != expected { t.Errorf("Expected %+v, actually received %+v", expected, config) }
+	})
+
+	t.Run("Precedence", func(t *testing.T) {
+		file := writeConfigFile(t, `{"listen": "file:1", "workers": 2, "autosave": "1m", "cache": "file.gz", "client-secret": "file-secret"}`)
+		t.Setenv("GHO_CONFIG", file)
+		t.Setenv("GHO_LISTEN", "env:2")
+		t.Setenv("GHO_WORKERS", "3")
+		config, err := LoadConfig("test", []string { "--listen", "flag:3", "--cache-honour-max-age" }, &bytes.Buffer{})
+		if err != nil { t.Fatalf("Failed to load config: %v", err) }
+		if config.Listen != "flag:3" { t.Errorf("Expected flag to override env and file, actually received %s", config.Listen) }
+		if config.Workers != 3 { t.Errorf("Expected env to override file, actually received %d", config.Workers) }
+		if config.Autosave != time.Minute || config.Cache != "file.gz" { t.Errorf("Expected file to override defaults, actually received %v and %s", config.Autosave, config.Cache) }
+		if config.ClientSecret != os.Getenv("GHO_CLIENT_SECRET") { t.Errorf("Expected env to override the secret in the file") }
+		if !config.CacheHonourMaxAge { t.Errorf("Expected boolean flag without a value to be set") }
+		if config.Public != DefaultConfig().Public { t.Errorf("Expected default public directory, actually received %s", config.Public) }
+	})
+
+	t.Run("Config flag", func(t *testing.T) {
+		t.Setenv("GHO_CONFIG", writeConfigFile(t, `{"workers": 2}`))
+		config, err := LoadConfig("test", []string { "--config", writeConfigFile(t, `{"workers": 4}`) }, &bytes.Buffer{})
+		if err != nil { t.Fatalf("Failed to load config: %v", err) }
+		if config.Workers != 4 { t.Errorf("Expected --config to override GHO_CONFIG, actually received %d workers", config.Workers) }
+	})
+
+	t.Run("Positional arguments", func(t *testing.T) {
+		output := &bytes.Buffer{}
+		config, err := LoadConfig("test", []string { "--cache", "flag.log", "8080", "public", "templates/*.html", "cache.gz" }, output)
+		if err != nil { t.Fatalf("Failed to load config: %v", err) }
+		if config.Listen != ":8080" || config.Public != "public" || config.Templates != "templates/*.html" {
+			t.Errorf("Expected positional arguments to be used, actually received %+v", config)
+		}
+		if config.Cache != "flag.log" { t.Errorf("Expected flag to override positional argument, actually received %s", config.Cache) }
+		if !strings.Contains(output.String(), "deprecated") { t.Errorf("Expected deprecation warning, actually received %q", output.String()) }
+	})
+
+	t.Run("Help", func(t *testing.T) {
+		output := &bytes.Buffer{}
+		if _, err := LoadConfig("test", []string { "--help" }, output); !errors.Is(err, flag.ErrHelp) {
+			t.Errorf("Expected flag.ErrHelp, actually received %v", err)
+		}
+		for _, expected := range []string { "command-line flag", "--listen", "GHO_LISTEN", "GHO_CONFIG", "(no flag) (env GHO_CLIENT_SECRET" } {
+			if !strings.Contains(output.String(), expected) { t.Errorf("Expected usage to contain %q, actually received:\n%s", expected, output.String()) }
+		}
+	})
+
+	testCases := []struct {
+		name string
+		args []string
+		file string
+		env map[string]string
+	}{
+		{ "Secret flag", []string { "--client-secret", "secret" }, "", nil },
+		{ "Extra arguments", []string { "8080" }, "", nil },
+		{ "Invalid flag value", []string { "--workers", "many" }, "", nil },
+		{ "Invalid env value", nil, "", map[string]string { "GHO_CACHE_MAX_AGE": "old" } },
+		{ "Invalid file value", nil, `{"autosave": true}`, nil },
+		{ "Unknown file key", nil, `{"port": 80}`, nil },
+		{ "Invalid file", nil, `listen = ":80"`, nil },
+		{ "Missing TLS key", []string { "--tls-cert", "cert.pem" }, "", nil },
+		{ "Redirect without TLS", []string { "--https-redirect", ":80" }, "", nil },
+		{ "No workers", []string { "--workers", "0" }, "", nil },
+		{ "Negative expand TTL", []string { "--expand-ttl", "-1h" }, "", nil },
+		{ "No crawlers", []string { "--crawlers", "0" }, "", nil },
+		{ "App without key", []string { "--app-id", "42", "--app-installation", "7" }, "", nil },
+		{ "Crawl tokens flag", []string { "--crawl-tokens", "token" }, "", nil },
+		{ "Invalid log level", []string { "--log-level", "loud" }, "", nil },
+		{ "Missing secret", nil, "", map[string]string { "GHO_CLIENT_SECRET": "" } },
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for key, value := range testCase.env { t.Setenv(key, value) }
+			if testCase.file != "" { t.Setenv("GHO_CONFIG", writeConfigFile(t, testCase.file)) }
+			if _, err := LoadConfig("test", testCase.args, &bytes.Buffer{}); err == nil {
+				t.Errorf("Expected error")
+			}
+		})
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	output := &bytes.Buffer{}
+	flags, prefix := log.Flags(), log.Prefix()
+	log.SetOutput(output)
+	log.SetFlags(0)
+	log.SetPrefix("")
+	defer log.SetOutput(os.Stderr)
+	defer log.SetFlags(flags)
+	defer log.SetPrefix(prefix)
+	defer setLogLevel(logInfo)
+
+	info, warning := "Setting up server...\n", "Warning - GET /users/alice returned 404\n"
+	testCases := []struct {
+		level string
+		expected string
+	}{
+		{ logInfo, info + warning },
+		{ logWarning, warning },
+		{ logSilent, "" },
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.level, func(t *testing.T) {
+			output.Reset()
+			setLogLevel(testCase.level)
+			infof("Setting up server...")
+			warnf("GET /users/%s returned %d", "alice", 404)
+			if output.String() != testCase.expected { t.Errorf("Expected %q, actually received %q", testCase.expected, output.String()) }
+		})
+	}
+}
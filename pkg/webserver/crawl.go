@@ -0,0 +1,114 @@
+package webserver
+
+// Depth crawled to for users who haven't saved one
+const defaultRequestedDepth = 99
+
+// What a WebSocket connection wants from the background crawl of its user. Each connection has its own, so two tabs of
+// the same user keep their own depth and target.
+type crawlState struct {
+	RequestedDepth int
+	Paused bool
+	Target string // Login searched for
+	Weight string // Weight function of the shortest path, see parseWeight
+	MinContributions int // Threshold of the threshold weight function
+}
+
+// The parts of a crawl state a user can save for their next visit
+type crawlPrefs struct {
+	RequestedDepth int
+	Weight string
+	MinContributions int
+}
+
+// Starts a paused crawl with the users saved preferences
+func (srv *server) newCrawlState(login string) crawlState {
+	prefs := srv.getPrefs(login)
+	return crawlState {
+		RequestedDepth: prefs.RequestedDepth,
+		Paused: true,
+		Weight: prefs.Weight,
+		MinContributions: prefs.MinContributions,
+	}
+}
+
+func (state crawlState) prefs() crawlPrefs {
+	return crawlPrefs { state.RequestedDepth, state.Weight, state.MinContributions }
+}
+
+// Looks up the preferences a user saved, or the defaults if they never did
+func (srv *server) getPrefs(login string) crawlPrefs {
+	srv.prefsMutex.Lock()
+	defer srv.prefsMutex.Unlock()
+	if prefs, ok := srv.prefs[login]; ok { return prefs }
+	return crawlPrefs { RequestedDepth: defaultRequestedDepth }
+}
+
+// Saves a users preferences, persisted with the next cache save
+func (srv *server) savePrefs(login string, prefs crawlPrefs) {
+	srv.prefsMutex.Lock()
+	defer srv.prefsMutex.Unlock()
+	srv.prefs[login] = prefs
+	srv.dirtyPrefs[login] = true
+}
+
+// Where a crawl of a root users collaborators left off
+type crawlFrontier struct {
+	Queue []string // Users left to scan, in order
+	Links map[string]string // Who each user found was found through, the root through ""
+	Depth int // Distance from the root of the users at the front of the queue
+	LevelSize int // Number of users at the front of the queue at Depth, the rest are one further away
+}
+
+// Copies the frontier so it can be read while the crawl carries on changing it
+func (f *crawlFrontier) copy() crawlFrontier {
+	links := make(map[string]string, len(f.Links))
+	for username, via := range f.Links { links[username] = via }
+	return crawlFrontier { append([]string{}, f.Queue...), links, f.Depth, f.LevelSize }
+}
+
+// Looks up where the crawl from the root user has got to, starting a crawl from them if there hasn't been one.
+// Only the job crawling from the root changes the frontier, through updateFrontier, so it may read it unlocked.
+func (srv *server) frontierFor(root string) *crawlFrontier {
+	srv.frontierMutex.Lock()
+	defer srv.frontierMutex.Unlock()
+	frontier, ok := srv.frontiers[root]
+	if !ok {
+		frontier = &crawlFrontier { []string { root }, map[string]string { root: "" }, 0, 1 }
+		srv.frontiers[root] = frontier
+	}
+	return frontier
+}
+
+// Copies where the crawl from the root user has got to
+func (srv *server) getFrontier(root string) crawlFrontier {
+	frontier := srv.frontierFor(root)
+	srv.frontierMutex.Lock()
+	defer srv.frontierMutex.Unlock()
+	return frontier.copy()
+}
+
+// Changes where the crawl from the root user has got to in place, persisted with the next cache save
+func (srv *server) updateFrontier(root string, update func(frontier *crawlFrontier)) {
+	frontier := srv.frontierFor(root)
+	srv.frontierMutex.Lock()
+	defer srv.frontierMutex.Unlock()
+	update(frontier)
+	srv.dirtyFrontiers[root] = true
+}
+
+// Returns the path from the root user to the target if the crawl from the root has linked them
+// Reports whether the crawl from the root user has linked the user, whether or not they have been scanned yet
+func (srv *server) frontierLinked(root, username string) bool {
+	frontier := srv.frontierFor(root)
+	srv.frontierMutex.Lock()
+	defer srv.frontierMutex.Unlock()
+	_, ok := frontier.Links[username]
+	return ok
+}
+
+func (srv *server) frontierPath(root, target string) []string {
+	frontier := srv.frontierFor(root)
+	srv.frontierMutex.Lock()
+	defer srv.frontierMutex.Unlock()
+	return srv.checkForTarget(target, target, frontier.Links)
+}
@@ -0,0 +1,224 @@
+package webserver
+
+import (
+	"testing"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/gorilla/websocket"
+)
+
+func TestCrawlState(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	srv.apiURL = setupTestGitHub(t, testGitHubData { "alice": {} }).URL
+	cache := filepath.Join(t.TempDir(), "cache.gz")
+	if err := srv.loadCache(cache); err != nil { t.Fatalf("Unable to load cache: %v", err) }
+
+	send := func(t *testing.T, ws *websocket.Conn, command string) {
+		if err := ws.WriteJSON(map[string]string { "command": command }); err != nil { t.Fatalf("Unable to send %s command: %v", command, err) }
+	}
+	waitForMaxDepth := func(t *testing.T, ws *websocket.Conn, expected int) {
+		var status statusFormat
+		for status.MaxDepth != expected { readTestWSMessage(t, ws, "paused", &status) }
+	}
+
+	// Tabs of the same user crawl independently
+	first := dialTestWSHandler(t, srv, "token-alice")
+	second := dialTestWSHandler(t, srv, "token-alice")
+	send(t, first, "minus")
+	waitForMaxDepth(t, first, defaultRequestedDepth - 1)
+	send(t, second, "plus")
+	waitForMaxDepth(t, second, defaultRequestedDepth + 1)
+	send(t, first, "minus")
+	waitForMaxDepth(t, first, defaultRequestedDepth - 2)
+	if prefs := srv.getPrefs("alice"); prefs.RequestedDepth != defaultRequestedDepth {
+		t.Errorf("Expected unsaved depth to be kept out of preferences, actually saved %d", prefs.RequestedDepth)
+	}
+
+	// Saved preferences are used by new connections and persisted
+	send(t, first, "save")
+	send(t, first, "minus")
+	waitForMaxDepth(t, first, defaultRequestedDepth - 3)
+	waitForMaxDepth(t, dialTestWSHandler(t, srv, "token-alice"), defaultRequestedDepth - 2)
+
+	if _, _, err := srv.saveCache(); err != nil { t.Fatalf("Unable to save cache: %v", err) }
+	loaded, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	if err := loaded.loadCache(cache); err != nil { t.Fatalf("Unable to load cache: %v", err) }
+	if prefs := loaded.getPrefs("alice"); prefs.RequestedDepth != defaultRequestedDepth - 2 {
+		t.Errorf("Expected saved depth %d to be loaded, actually loaded %d", defaultRequestedDepth - 2, prefs.RequestedDepth)
+	}
+	if prefs := loaded.getPrefs("bob"); prefs.RequestedDepth != defaultRequestedDepth {
+		t.Errorf("Expected default depth for a user without preferences, actually %d", prefs.RequestedDepth)
+	}
+}
+
+// Proxies the fake GitHub, recording whose repositories are listed. Returns the proxy URL and a function listing the
+// users scanned so far.
+func recordTestScans(t *testing.T, github *httptest.Server) (string, func() []string) {
+	var scanned []string
+	var scannedMutex sync.Mutex
+	githubURL, _ := url.Parse(github.URL)
+	proxy := httputil.NewSingleHostReverseProxy(githubURL)
+	recorder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/repos") {
+			scannedMutex.Lock()
+			scanned = append(scanned, strings.Split(r.URL.Path, "/")[2])
+			scannedMutex.Unlock()
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(recorder.Close)
+	return recorder.URL, func() []string {
+		scannedMutex.Lock()
+		defer scannedMutex.Unlock()
+		return append([]string{}, scanned...)
+	}
+}
+
+func TestCrawlFrontier(t *testing.T) {
+	github := setupTestGitHub(t, testGitHubData {
+		"alice": { "a": { "bob": 1 } },
+		"bob": { "b": { "carol": 1 } },
+		"carol": { "c": { "dave": 1 } },
+		"dave": {},
+	})
+	cache := filepath.Join(t.TempDir(), "cache.gz")
+
+	// Crawl to depth 1, where the crawl waits
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	srv.apiURL = github.URL
+	if err := srv.loadCache(cache); err != nil { t.Fatalf("Unable to load cache: %v", err) }
+	srv.savePrefs("alice", crawlPrefs { RequestedDepth: 1 })
+	ws := dialTestWSHandler(t, srv, "token-alice")
+	if err := ws.WriteJSON(map[string]string { "command": "continue" }); err != nil { t.Fatalf("Unable to send continue command: %v", err) }
+	var status statusFormat
+	for status.Depth != 2 || status.Working { readTestWSMessage(t, ws, "paused", &status) }
+	ws.Close()
+
+	frontier := srv.getFrontier("alice")
+	expected := crawlFrontier { []string { "carol" }, map[string]string { "alice": "", "bob": "alice", "carol": "bob" }, 1, 0 }
+	if fmt.Sprint(frontier) != fmt.Sprint(expected) { t.Errorf("Expected frontier: %v - Actual frontier: %v", expected, frontier) }
+	if _, _, err := srv.saveCache(); err != nil { t.Fatalf("Unable to save cache: %v", err) }
+
+	// Restart, revalidating every cached response so scans show up as requests
+	loaded, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	if err := loaded.loadCache(cache); err != nil { t.Fatalf("Unable to load cache: %v", err) }
+	recorder, scanned := recordTestScans(t, github)
+	loaded.apiURL, loaded.ttlPolicy = recorder, ttlPolicy{}
+	if frontier := loaded.getFrontier("alice"); fmt.Sprint(frontier) != fmt.Sprint(expected) {
+		t.Errorf("Expected loaded frontier: %v - Actual frontier: %v", expected, frontier)
+	}
+
+	// The crawl carries on from carol and ends once everyone has been scanned
+	loaded.savePrefs("alice", crawlPrefs { RequestedDepth: defaultRequestedDepth })
+	ws = dialTestWSHandler(t, loaded, "token-alice")
+	if err := ws.WriteJSON(map[string]string { "command": "continue" }); err != nil { t.Fatalf("Unable to send continue command: %v", err) }
+	for !status.Finished { readTestWSMessage(t, ws, "paused", &status) }
+	if fmt.Sprint(scanned()) != "[carol dave]" { t.Errorf("Expected only carol and dave to be scanned, actually scanned: %v", scanned()) }
+	if frontier := loaded.getFrontier("alice"); len(frontier.Queue) != 0 || len(frontier.Links) != 4 {
+		t.Errorf("Expected finished frontier with 4 users, actually: %v", frontier)
+	}
+}
+
+func TestExpanded(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	now := time.Now()
+	srv.now, srv.expandTTL = func() time.Time { return now }, time.Hour
+
+	testCases := []struct {
+		name string
+		entry *userEntry
+		expected bool
+	}{
+		{ "Unknown", nil, false },
+		{ "Fresh", &userEntry { Collaborators: []string{}, Expanded: now.Add(-time.Minute) }, true },
+		{ "Stale", &userEntry { Collaborators: []string{}, Expanded: now.Add(-2 * time.Hour) }, false },
+		{ "No timestamp", &userEntry { Collaborators: []string{} }, false },
+		{ "Not scanned", &userEntry { Expanded: now }, false },
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.entry != nil { srv.updateUser(testCase.name, func(entry *userEntry) { *entry = *testCase.entry }) }
+			if srv.expanded(testCase.name) != testCase.expected { t.Errorf("Expected expanded to be %t", testCase.expected) }
+		})
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+
+	// Alice starts working with carol once she has been scanned
+	before, _ := url.Parse(setupTestGitHub(t, testGitHubData { "alice": { "a": { "bob": 1 } }, "bob": {}, "carol": {} }).URL)
+	after, _ := url.Parse(setupTestGitHub(t, testGitHubData { "alice": { "a": { "bob": 1, "carol": 1 } }, "bob": {}, "carol": {} }).URL)
+	var started int32
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream := before
+		if atomic.LoadInt32(&started) != 0 { upstream = after }
+		httputil.NewSingleHostReverseProxy(upstream).ServeHTTP(w, r)
+	}))
+	t.Cleanup(github.Close)
+	recorder, scanned := recordTestScans(t, github)
+	srv.apiURL = recorder
+	srv.savePrefs("alice", crawlPrefs { RequestedDepth: 0 })
+	readCollaborators := func(t *testing.T, ws *websocket.Conn) string {
+		var data userCollaboratorsFormat
+		readTestWSMessage(t, ws, "username", &data)
+		logins := []string{}
+		for _, collaborator := range data.Collaborators { logins = append(logins, collaborator.Login) }
+		return data.Username + " " + fmt.Sprint(logins)
+	}
+
+	ws := dialTestWSHandler(t, srv, "token-alice")
+	if err := ws.WriteJSON(map[string]string { "command": "continue" }); err != nil { t.Fatalf("Unable to send continue command: %v", err) }
+	if received := readCollaborators(t, ws); received != "alice [bob]" { t.Errorf("Expected collaborators before carol, actually received %s", received) }
+	var status statusFormat
+	for status.Depth != 1 || status.Working { readTestWSMessage(t, ws, "paused", &status) }
+	atomic.StoreInt32(&started, 1)
+
+	// Refreshing her scans her again while the crawl waits at its depth, although her cached responses are fresh
+	if err := ws.WriteJSON(map[string]string { "command": "refresh", "login": "alice" }); err != nil { t.Fatalf("Unable to send refresh command: %v", err) }
+	if received := readCollaborators(t, ws); received != "alice [bob carol]" { t.Errorf("Expected refreshed collaborators, actually received %s", received) }
+	if fmt.Sprint(scanned()) != "[alice alice]" { t.Errorf("Expected only alice to be scanned again, actually scanned: %v", scanned()) }
+	if frontier := srv.getFrontier("alice"); fmt.Sprint(frontier.Queue) != "[bob carol]" {
+		t.Errorf("Expected carol to be queued, actually queued: %v", frontier.Queue)
+	}
+}
+
+func TestRefreshFinishedCrawl(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	recorder, scanned := recordTestScans(t, setupTestGitHub(t, testGitHubData { "alice": {} }))
+	srv.apiURL = recorder
+	srv.subscribeCrawl("alice", "token-alice", &crawlSubscriber { depth: defaultRequestedDepth, notify: func(crawlEvent) {} })
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if !srv.waitForCrawls(ctx) || !srv.crawlStatusFor("alice").Finished { t.Fatalf("Expected the crawl to finish") }
+
+	// Refreshing nobody, or someone the crawl hasn't linked, is ignored
+	srv.refreshCrawl("alice", "")
+	srv.refreshCrawl("alice", "mallory")
+	srv.jobCond.L.Lock()
+	if refresh := srv.jobFor("alice").refresh; len(refresh) != 0 { t.Errorf("Expected no refreshes, actually queued: %v", refresh) }
+
+	// A finished crawl woken up with nothing to refresh stops again
+	job := srv.jobFor("alice")
+	job.refresh = []string { "" }
+	srv.scheduleJob(job)
+	srv.jobCond.L.Unlock()
+	if !srv.waitForCrawls(ctx) || !srv.crawlStatusFor("alice").Finished { t.Errorf("Expected the crawl to stay finished") }
+	if fmt.Sprint(scanned()) != "[alice]" { t.Errorf("Expected only alice to be scanned, actually scanned: %v", scanned()) }
+}
@@ -0,0 +1,399 @@
+package webserver
+
+import (
+	"os"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Number of background crawls run at once
+const defaultCrawlers = 2
+
+// Depth seeded crawls are crawled to
+const defaultSeedDepth = 2
+
+// How long a job waits before scanning a user again after a scan failed, doubling with each failure in a row up to
+// the most it waits
+const defaultCrawlBackoff = 5 * time.Second
+const maxCrawlBackoff = 10 * time.Minute
+
+// A crawl of the collaborators of a root user, run in the background by a crawler and shared by everyone subscribed to
+// it. Its fields are guarded by the job lock.
+type crawlJob struct {
+	root string
+	keptDepth int // Deepest the seeds and subscribers who left asked for, kept until someone pauses the job, -1 if none
+	keptTargets []string // Users the subscribers who left were searching for, pausing the job once one is linked
+	subscribers map[*crawlSubscriber]bool
+	auth string // Token of the latest subscriber, used if the token pool is empty, even after they leave
+	token string // Token the job last scanned with
+	queued bool // Waiting for a crawler
+	running bool
+	working bool // Scanning rather than waiting for someone to want it crawled further or the rate limit to reset
+	finished bool // Every user reachable from the root has been scanned
+	depth int // Distance from the root of the users being scanned
+	refresh []string // Users to scan again, even if their collaborators are fresh
+	failures int // Scans failed in a row
+	retryAt time.Time // When to scan again after a failed scan
+}
+
+// Someone following a job, such as a browser tab
+type crawlSubscriber struct {
+	depth int // Depth they want the job crawled to, -1 if they don't want it crawled. Guarded by the job lock.
+	target string // User they're searching for, pausing the job once they're linked, "" if none. Guarded by the job lock.
+	notify func(event crawlEvent) // Called by the job without the job lock held. Must not block, as it holds up the job.
+}
+
+// Progress of a job. Status changes have no username.
+type crawlEvent struct {
+	Username string // User who was scanned
+	Depth int // Distance of the user from the root
+	Children []string // Collaborators linked through the user
+	Collaborators *userCollaboratorsFormat // Nil if their profiles couldn't be fetched
+}
+
+// What subscribers are shown about a job
+type crawlStatus struct {
+	Depth int
+	Working bool
+	Finished bool
+	Token string
+}
+
+// Deepest anyone wants the job crawled to, -1 if nobody does. Must be called with the job lock held.
+func (job *crawlJob) maxDepth() int {
+	depth := job.keptDepth
+	for sub := range job.subscribers {
+		if sub.depth > depth { depth = sub.depth }
+	}
+	return depth
+}
+
+// Looks up the job crawling from the root user, creating it if there isn't one. Must be called with the job lock held.
+func (srv *server) jobFor(root string) *crawlJob {
+	job, ok := srv.jobs[root]
+	if !ok {
+		job = &crawlJob { root: root, keptDepth: -1, subscribers: map[*crawlSubscriber]bool{} }
+		srv.jobs[root] = job
+	}
+	return job
+}
+
+// Subscribes to the crawl from the root user, which uses the token if the token pool is empty
+func (srv *server) subscribeCrawl(root, auth string, sub *crawlSubscriber) {
+	srv.jobCond.L.Lock()
+	defer srv.jobCond.L.Unlock()
+	job := srv.jobFor(root)
+	job.subscribers[sub] = true
+	job.auth = auth
+	srv.scheduleJob(job)
+}
+
+// Stops following the crawl from the root user, which carries on as deep as the subscriber asked without them
+func (srv *server) unsubscribeCrawl(root string, sub *crawlSubscriber) {
+	srv.jobCond.L.Lock()
+	defer srv.jobCond.L.Unlock()
+	job := srv.jobFor(root)
+	delete(job.subscribers, sub)
+	if sub.depth > job.keptDepth { job.keptDepth = sub.depth }
+	if sub.target != "" && sub.depth >= 0 { job.keptTargets = append(job.keptTargets, sub.target) }
+	srv.jobCond.Broadcast()
+}
+
+// Sets how deep the subscriber wants the crawl from the root user to go, -1 if they don't want it crawled
+func (srv *server) setCrawlDemand(root string, sub *crawlSubscriber, depth int) {
+	srv.jobCond.L.Lock()
+	defer srv.jobCond.L.Unlock()
+	sub.depth = depth
+	srv.scheduleJob(srv.jobFor(root))
+}
+
+// Sets who the subscriber is searching for from the root user, "" if nobody
+func (srv *server) setCrawlTarget(root string, sub *crawlSubscriber, target string) {
+	srv.jobCond.L.Lock()
+	defer srv.jobCond.L.Unlock()
+	sub.target = target
+}
+
+// Pauses the crawl from the root user on behalf of the subscriber, dropping the depth seeds and subscribers who left
+// asked for, so it only carries on as deep as the subscribers still following it want
+func (srv *server) pauseCrawl(root string, sub *crawlSubscriber) {
+	srv.jobCond.L.Lock()
+	defer srv.jobCond.L.Unlock()
+	srv.pauseJob(srv.jobFor(root), sub)
+}
+
+// Must be called with the job lock held
+func (srv *server) pauseJob(job *crawlJob, sub *crawlSubscriber) {
+	sub.depth, sub.target = -1, ""
+	job.keptDepth, job.keptTargets = -1, nil
+	srv.scheduleJob(job)
+}
+
+// Pauses the job on behalf of whoever was searching for any of the users just linked, whether or not they're still
+// following it
+func (srv *server) linkedTargets(job *crawlJob, linked []string) {
+	srv.jobCond.L.Lock()
+	defer srv.jobCond.L.Unlock()
+	for _, username := range linked {
+		for sub := range job.subscribers {
+			if sub.target == username { srv.pauseJob(job, sub) }
+		}
+		for _, target := range job.keptTargets {
+			if target == username { job.keptDepth, job.keptTargets = -1, nil }
+		}
+	}
+}
+
+// Asks the crawl from the root user to scan a user it has linked again. Anyone else is ignored.
+func (srv *server) refreshCrawl(root, username string) {
+	if username == "" || !srv.frontierLinked(root, username) { return }
+	srv.jobCond.L.Lock()
+	defer srv.jobCond.L.Unlock()
+	job := srv.jobFor(root)
+	job.refresh = append(job.refresh, username)
+	srv.scheduleJob(job)
+}
+
+func (srv *server) crawlStatusFor(root string) crawlStatus {
+	srv.jobCond.L.Lock()
+	defer srv.jobCond.L.Unlock()
+	job := srv.jobFor(root)
+	return crawlStatus { job.depth, job.working, job.finished, job.token }
+}
+
+// Starts a background crawl to the depth from every login listed in the file, one per line.
+// Blank lines and lines starting with # are skipped.
+func (srv *server) seedCrawls(file string, depth int) error {
+	buf, err := os.ReadFile(file)
+	if err != nil { return err }
+	if len(srv.tokenPool) == 0 { warnf("Seeded crawls without a token pool are limited to 60 requests an hour") }
+
+	srv.jobCond.L.Lock()
+	defer srv.jobCond.L.Unlock()
+	seeded := 0
+	for _, line := range strings.Split(string(buf), "\n") {
+		login := strings.TrimSpace(line)
+		if login == "" || strings.HasPrefix(login, "#") { continue }
+		job := srv.jobFor(login)
+		if depth > job.keptDepth { job.keptDepth = depth }
+		srv.scheduleJob(job)
+		seeded++
+	}
+	infof("Seeded %d background crawls to depth %d", seeded, depth)
+	return nil
+}
+
+// Queues the job for a crawler unless it's already queued or running, starting another crawler if there are fewer
+// than allowed. Wakes the job up in case it's waiting. Must be called with the job lock held.
+func (srv *server) scheduleJob(job *crawlJob) {
+	srv.jobCond.Broadcast()
+	if job.queued || job.running || srv.jobsStopped { return }
+	if len(job.refresh) == 0 && (job.finished || job.maxDepth() < 0) { return }
+	job.queued = true
+	srv.pendingJobs = append(srv.pendingJobs, job)
+	if srv.runningCrawlers < srv.crawlers {
+		srv.runningCrawlers++
+		srv.crawlGroup.Add(1)
+		go srv.runCrawler()
+	}
+}
+
+// Runs queued jobs until there are none left
+func (srv *server) runCrawler() {
+	defer srv.crawlGroup.Done()
+	srv.jobCond.L.Lock()
+	for !srv.jobsStopped && len(srv.pendingJobs) != 0 {
+		job := srv.pendingJobs[0]
+		srv.pendingJobs = srv.pendingJobs[1:]
+		job.queued, job.running = false, true
+		srv.jobCond.L.Unlock()
+		srv.runJob(job)
+		srv.jobCond.L.Lock()
+	}
+	srv.runningCrawlers--
+	srv.jobCond.L.Unlock()
+}
+
+// Stops every job. No jobs start afterwards.
+func (srv *server) stopJobs() {
+	srv.jobCond.L.Lock()
+	defer srv.jobCond.L.Unlock()
+	srv.jobsStopped = true
+	for _, job := range srv.pendingJobs { job.queued = false }
+	srv.pendingJobs = nil
+	srv.jobCond.Broadcast()
+}
+
+// Calls every subscriber of the job with the event
+func (srv *server) notifyJob(job *crawlJob, event crawlEvent) {
+	srv.jobCond.L.Lock()
+	subscribers := make([]*crawlSubscriber, 0, len(job.subscribers))
+	for sub := range job.subscribers { subscribers = append(subscribers, sub) }
+	srv.jobCond.L.Unlock()
+	for _, sub := range subscribers { sub.notify(event) }
+}
+
+// Waits until the job may scan another user, returning the token to scan with and any user to scan again first.
+// Returns false once nobody wants the job crawled any further or the crawlers have stopped.
+func (srv *server) waitForJob(job *crawlJob, depth int, finished bool) (string, string, bool) {
+	c := srv.jobCond
+	c.L.Lock()
+	defer c.L.Unlock()
+	for {
+		job.depth, job.finished = depth, finished
+		if srv.jobsStopped || len(job.refresh) == 0 && (finished || depth > job.maxDepth()) {
+			job.running, job.working = false, false
+			return "", "", false
+		}
+
+		// Back off after a failed scan
+		if wait := time.Until(job.retryAt); wait > 0 {
+			time.AfterFunc(wait, c.Broadcast)
+			c.Wait()
+			continue
+		}
+
+		// Pick a token without holding the lock, as GitHub App tokens may need creating
+		fallback := job.auth
+		c.L.Unlock()
+		auth, until := srv.crawlToken(fallback)
+		c.L.Lock()
+		if until.IsZero() {
+			job.working, job.token = true, auth
+			refresh := ""
+			if len(job.refresh) != 0 { refresh, job.refresh = job.refresh[0], job.refresh[1:] }
+			return auth, refresh, true
+		}
+
+		// Let subscribers know the job is rate limited before waiting for the first token to reset
+		if job.working {
+			job.working = false
+			c.L.Unlock()
+			srv.notifyJob(job, crawlEvent{})
+			c.L.Lock()
+			continue
+		}
+		infof("Rate limit exceeded crawling from %s, waiting until %s...", job.root, until.Format(time.RFC1123))
+		time.AfterFunc(time.Until(until), c.Broadcast)
+		c.Wait()
+	}
+}
+
+// Crawls breadth-first from where the last crawl from the root user left off, until nobody wants it crawled further.
+// The frontier is changed in place, so each scan costs only as much as the collaborators it links.
+func (srv *server) runJob(job *crawlJob) {
+	frontier := srv.frontierFor(job.root)
+	infof("Crawling from %s at depth %d...", job.root, frontier.Depth)
+
+	for {
+		// The next user scanned is on the next level once this one has been scanned
+		next := frontier.Depth
+		if frontier.LevelSize == 0 { next++ }
+		auth, refresh, ok := srv.waitForJob(job, next, len(frontier.Queue) == 0)
+		srv.notifyJob(job, crawlEvent{})
+		if !ok { break }
+
+		// Link and enqueue every unique collaborator of a scanned user, dequeuing them first if they're at the front
+		// of the queue, so the frontier is complete whenever it's saved. Returns the collaborators linked through them.
+		link := func(username string, dequeue bool) []string {
+			entry, _ := srv.getUser(username)
+			children := []string{}
+			srv.updateFrontier(job.root, func(frontier *crawlFrontier) {
+				if dequeue {
+					frontier.Queue = frontier.Queue[1:]
+					frontier.LevelSize--
+				}
+				for _, collaborator := range entry.Collaborators {
+					//if collaborator == "exclude whoever" { continue }
+					if _, ok := frontier.Links[collaborator]; !ok {
+						frontier.Links[collaborator] = username
+						frontier.Queue = append(frontier.Queue, collaborator)
+					}
+					if frontier.Links[collaborator] == username { children = append(children, collaborator) }
+				}
+			})
+			srv.linkedTargets(job, children)
+			return children
+		}
+
+		// Scan a user again on request, revalidating the responses listing their collaborators however fresh they
+		// are. Users still queued are linked once they're dequeued.
+		if refresh != "" {
+			_, scanned := frontier.Links[refresh]
+			for _, username := range frontier.Queue { if username == refresh { scanned = false } }
+			if err := srv.addCollaborators(requestOptions { Auth: auth, Revalidate: true }, refresh); err != nil {
+				warnf("Refreshing %s failed: %v", refresh, err)
+			} else if scanned {
+				children := link(refresh, false)
+				srv.publishCollaborators(job, auth, refresh, linkDepth(frontier.Links, refresh), children)
+			}
+			continue
+		}
+		if len(frontier.Queue) == 0 { continue }
+
+		// Scan the next user unless their collaborators are fresh, retrying them once the rate limit resets
+		if frontier.LevelSize == 0 {
+			srv.updateFrontier(job.root, func(frontier *crawlFrontier) { frontier.Depth, frontier.LevelSize = next, len(frontier.Queue) })
+		}
+		username := frontier.Queue[0]
+		if !srv.expanded(username) {
+			err := srv.addCollaborators(requestOptions { Auth: auth }, username)
+			if errors.Is(err, errRateLimited) || srv.retryScan(job, auth, username, err) { continue }
+		}
+		children := link(username, true)
+		srv.publishCollaborators(job, auth, username, frontier.Depth, children)
+	}
+	infof("Stopped crawling from %s at depth %d.", job.root, frontier.Depth)
+}
+
+// Reports whether a user the job failed to scan should stay at the front of its queue to be scanned again, once the job
+// has waited longer than after the last failure. Users GitHub refused to list the repositories of are skipped. A token
+// GitHub rejected, e.g. as its owner logged out, is no longer used by the job.
+func (srv *server) retryScan(job *crawlJob, auth, username string, err error) bool {
+	srv.jobCond.L.Lock()
+	defer srv.jobCond.L.Unlock()
+	var status statusError
+	if err == nil || errors.As(err, &status) && status.Status < 500 && status.Status != http.StatusUnauthorized {
+		if err != nil { warnf("Scanning %s failed, skipping them: %v", username, err) }
+		job.failures = 0
+		return false
+	}
+	if errors.As(err, &status) && status.Status == http.StatusUnauthorized && job.auth == auth { job.auth = "" }
+
+	backoff := srv.crawlBackoff << job.failures
+	if backoff > maxCrawlBackoff || backoff <= 0 { backoff = maxCrawlBackoff }
+	job.failures++
+	job.retryAt = time.Now().Add(backoff)
+	warnf("Scanning %s failed, retrying in %v: %v", username, backoff, err)
+	return true
+}
+
+// Stops jobs falling back on the token once it's revoked, e.g. as its owner logged out
+func (srv *server) forgetCrawlToken(auth string) {
+	srv.jobCond.L.Lock()
+	defer srv.jobCond.L.Unlock()
+	for _, job := range srv.jobs {
+		if job.auth == auth { job.auth = "" }
+	}
+}
+
+// Sends the collaborators linked through a scanned user to the jobs subscribers, if it has any
+func (srv *server) publishCollaborators(job *crawlJob, auth, username string, depth int, children []string) {
+	srv.jobCond.L.Lock()
+	subscribed := len(job.subscribers) != 0
+	srv.jobCond.L.Unlock()
+	if !subscribed { return }
+
+	event := crawlEvent { username, depth, children, nil }
+	if data, ok := srv.userCollaborators(auth, username, children); ok { event.Collaborators = &data }
+	srv.notifyJob(job, event)
+}
+
+// Distance of a linked user from the root
+func linkDepth(links map[string]string, username string) int {
+	depth := 0
+	for via := links[username]; via != ""; via = links[via] { depth++ }
+	return depth
+}
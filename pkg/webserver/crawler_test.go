@@ -0,0 +1,225 @@
+package webserver
+
+import (
+	"testing"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+func TestSharedCrawl(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	recorder, scanned := recordTestScans(t, setupTestGitHub(t, testGitHubData {
+		"alice": { "a": { "bob": 1 } },
+		"bob": { "b": { "carol": 1 } },
+		"carol": {},
+	}))
+	srv.apiURL, srv.ttlPolicy = recorder, ttlPolicy{}
+
+	// Only the first tab asks for the crawl, but both follow it
+	first := dialTestWSHandler(t, srv, "token-alice")
+	second := dialTestWSHandler(t, srv, "token-alice")
+	var status statusFormat
+	readTestWSMessage(t, second, "paused", &status)
+	if err := first.WriteJSON(map[string]string { "command": "continue" }); err != nil { t.Fatalf("Unable to send continue command: %v", err) }
+
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var received []string
+	for !status.Finished {
+		var msg map[string]json.RawMessage
+		if err := second.ReadJSON(&msg); err != nil { t.Fatalf("Unable to read message: %v", err) }
+		buf, _ := json.Marshal(msg)
+		if _, ok := msg["username"]; ok {
+			var data userCollaboratorsFormat
+			json.Unmarshal(buf, &data)
+			received = append(received, fmt.Sprint(data.Username, len(data.Collaborators)))
+		} else if _, ok := msg["paused"]; ok {
+			json.Unmarshal(buf, &status)
+		}
+	}
+	if fmt.Sprint(received) != "[alice1 bob1 carol0]" { t.Errorf("Expected the second tab to follow the crawl, actually received: %v", received) }
+	if fmt.Sprint(scanned()) != "[alice bob carol]" { t.Errorf("Expected everyone to be scanned once, actually scanned: %v", scanned()) }
+}
+
+func TestUnattendedCrawl(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	github, _ := url.Parse(setupTestGitHub(t, testGitHubData {
+		"alice": { "a": { "bob": 1 } },
+		"bob": { "b": { "carol": 1 } },
+		"carol": { "c": { "dave": 1 } },
+		"dave": {},
+	}).URL)
+
+	// Hold bob back until the tab has gone
+	left := make(chan struct{})
+	gate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/users/bob/repos" { <-left }
+		httputil.NewSingleHostReverseProxy(github).ServeHTTP(w, r)
+	}))
+	t.Cleanup(gate.Close)
+	recorder, scanned := recordTestScans(t, gate)
+	srv.apiURL = recorder
+	srv.savePrefs("alice", crawlPrefs { RequestedDepth: 2 })
+
+	// The only tab asks for the crawl and closes part way through
+	ws := dialTestWSHandler(t, srv, "token-alice")
+	if err := ws.WriteJSON(map[string]string { "command": "continue" }); err != nil { t.Fatalf("Unable to send continue command: %v", err) }
+	var data userCollaboratorsFormat
+	readTestWSMessage(t, ws, "username", &data)
+	ws.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		srv.jobCond.L.Lock()
+		subscribed := len(srv.jobFor("alice").subscribers) != 0
+		srv.jobCond.L.Unlock()
+		if !subscribed { break }
+		if time.Now().After(deadline) { t.Fatalf("Expected the tab to unsubscribe") }
+	}
+	close(left)
+
+	// The crawl carries on to the depth the tab asked for with its token
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if !srv.waitForCrawls(ctx) { t.Fatalf("Expected the crawl to finish") }
+	if fmt.Sprint(scanned()) != "[alice bob carol]" { t.Errorf("Expected the crawl to reach depth 2, actually scanned: %v", scanned()) }
+	if status := srv.crawlStatusFor("alice"); status.Token != "token-alice" || status.Depth != 3 {
+		t.Errorf("Expected alice to be crawled with her token to depth 3, actually: %+v", status)
+	}
+
+	// Pausing drops the depth the tab asked for
+	sub := &crawlSubscriber { depth: -1, notify: func(crawlEvent) {} }
+	srv.subscribeCrawl("alice", "token-alice", sub)
+	srv.pauseCrawl("alice", sub)
+	srv.jobCond.L.Lock()
+	if depth := srv.jobFor("alice").maxDepth(); depth != -1 { t.Errorf("Expected nobody to want the crawl after pausing, actually depth %d", depth) }
+	srv.jobCond.L.Unlock()
+}
+
+func TestCrawlRetries(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	github, _ := url.Parse(setupTestGitHub(t, testGitHubData {
+		"alice": { "a": { "bob": 1, "carol": 1 } },
+		"bob": { "b": { "dave": 1 } },
+		"dave": {},
+	}).URL)
+
+	// GitHub fails to list bob's repositories twice, then rejects alice's token as she has logged out
+	var bobFailures int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/users/bob/repos" && atomic.AddInt32(&bobFailures, 1) <= 2:
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		case r.URL.Path == "/users/dave/repos" && r.Header.Get("Authorization") == "token token-alice":
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		httputil.NewSingleHostReverseProxy(github).ServeHTTP(w, r)
+	}))
+	t.Cleanup(flaky.Close)
+	recorder, scanned := recordTestScans(t, flaky)
+	srv.apiURL, srv.ttlPolicy, srv.crawlBackoff = recorder, ttlPolicy{}, time.Millisecond
+
+	sub := &crawlSubscriber { depth: defaultRequestedDepth, notify: func(crawlEvent) {} }
+	srv.subscribeCrawl("alice", "token-alice", sub)
+	srv.unsubscribeCrawl("alice", sub)
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if !srv.waitForCrawls(ctx) { t.Fatalf("Expected the crawl to finish") }
+
+	// Failed scans are retried, carol who doesn't exist is skipped and dave is scanned again without the revoked token
+	if fmt.Sprint(scanned()) != "[alice bob bob bob carol dave dave]" { t.Errorf("Expected failed scans to be retried, actually scanned: %v", scanned()) }
+	frontier := srv.getFrontier("alice")
+	if frontier.Links["dave"] != "bob" || len(frontier.Queue) != 0 { t.Errorf("Expected dave to be linked through bob, actually: %+v", frontier) }
+	if status := srv.crawlStatusFor("alice"); !status.Finished || status.Token != "" {
+		t.Errorf("Expected the crawl to finish without the revoked token, actually: %+v", status)
+	}
+}
+
+func TestCrawlTargets(t *testing.T) {
+	github := setupTestGitHub(t, testGitHubData {
+		"alice": { "a": { "bob": 1 } },
+		"bob": { "b": { "carol": 1 } },
+		"carol": { "c": { "dave": 1 } },
+		"dave": { "d": { "erin": 1 } },
+		"erin": {},
+	})
+
+	// The crawl pauses once carol is linked, whether the tab searching for her never hears of it or has left
+	for _, leaves := range []bool { false, true } {
+		srv, err := setupTestServer()
+		if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+		recorder, scanned := recordTestScans(t, github)
+		srv.apiURL, srv.ttlPolicy = recorder, ttlPolicy{}
+
+		sub := &crawlSubscriber { depth: defaultRequestedDepth, target: "carol", notify: func(crawlEvent) {} }
+		srv.subscribeCrawl("alice", "token-alice", sub)
+		if leaves { srv.unsubscribeCrawl("alice", sub) }
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		if !srv.waitForCrawls(ctx) { t.Fatalf("Expected the crawl to pause (leaves: %t)", leaves) }
+		cancel()
+
+		if fmt.Sprint(scanned()) != "[alice bob]" { t.Errorf("Expected the crawl to stop at carol (leaves: %t), actually scanned: %v", leaves, scanned()) }
+		if path := srv.frontierPath("alice", "carol"); fmt.Sprint(path) != "[alice bob carol]" { t.Errorf("Expected carol to be linked, actually %v", path) }
+		srv.jobCond.L.Lock()
+		if depth := srv.jobFor("alice").maxDepth(); depth != -1 { t.Errorf("Expected nobody to want the crawl (leaves: %t), actually depth %d", leaves, depth) }
+		srv.jobCond.L.Unlock()
+	}
+}
+
+func TestSeedCrawls(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	recorder, scanned := recordTestScans(t, setupTestGitHub(t, testGitHubData {
+		"alice": { "a": { "carol": 1 } },
+		"bob": { "b": { "erin": 1 } },
+		"carol": { "c": { "dave": 1 } },
+		"dave": {},
+		"erin": {},
+	}))
+	srv.apiURL, srv.ttlPolicy = recorder, ttlPolicy{}
+	if err := srv.loadTokenPool("token-pool", 0, 0, ""); err != nil { t.Fatalf("Unable to load token pool: %v", err) }
+
+	seeds := filepath.Join(t.TempDir(), "seeds.txt")
+	if err := os.WriteFile(seeds, []byte("# Team\nalice\n\n  bob  \n"), 0644); err != nil { t.Fatalf("Unable to write seeds: %v", err) }
+	if err := srv.seedCrawls(seeds, 1); err != nil { t.Fatalf("Unable to seed crawls: %v", err) }
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if !srv.waitForCrawls(ctx) { t.Fatalf("Expected seeded crawls to finish") }
+
+	// Both crawls stop at the seed depth, without anyone subscribed
+	crawled := scanned()
+	sort.Strings(crawled)
+	if fmt.Sprint(crawled) != "[alice bob carol erin]" { t.Errorf("Expected the seeds to be crawled to depth 1, actually scanned: %v", crawled) }
+	for _, root := range []string { "alice", "bob" } {
+		if status := srv.crawlStatusFor(root); status.Token != "token-pool" || status.Working || status.Depth != 2 {
+			t.Errorf("Expected %s to be crawled with the pool to depth 2, actually: %+v", root, status)
+		}
+	}
+	if err := srv.seedCrawls(filepath.Join(t.TempDir(), "missing.txt"), 1); err == nil { t.Errorf("Expected error seeding from a missing file") }
+}
+
+func TestStopJobs(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	srv.apiURL = setupTestGitHub(t, testGitHubData { "alice": {} }).URL
+
+	// Crawlers don't start once stopped
+	srv.stopJobs()
+	srv.subscribeCrawl("alice", "token-alice", &crawlSubscriber { depth: defaultRequestedDepth, notify: func(crawlEvent) {} })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !srv.waitForCrawls(ctx) { t.Errorf("Expected no crawlers to be running") }
+	if _, ok := srv.getUser("alice"); ok { t.Errorf("Expected alice not to be scanned after stopping") }
+}
@@ -36,6 +36,9 @@ type userFormat struct {
 	Plan                    string    `json:"plan,omitempty"`
 	LdapDn                  string    `json:"ldap_dn,omitempty"`
 
+	// Contributions is only populated when listing repository contributors
+	Contributions           int       `json:"contributions,omitempty"`
+
 	// API URLs
 	URL               string `json:"url,omitempty"`
 	EventsURL         string `json:"events_url,omitempty"`
@@ -1,91 +1,273 @@
 package webserver
 
 import (
-	"log"
 	"net/http"
 	"encoding/json"
 	"sort"
-	"github.com/gorilla/websocket"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type userEntry struct {
-	RequestedDepth int
 	Collaborators []string
+	Repos map[string][]repoLink // Repositories of this user each collaborator contributed to
+	Expanded time.Time // When the collaborators were scanned, zero in caches from before it was recorded
 }
 
-func (srv *server) sendUserCollaborators(w http.ResponseWriter, ws *websocket.Conn, auth, username string, collaborators []string) {
+// How long scanned collaborators are reused before the user is scanned again
+const defaultExpandTTL = 24 * time.Hour
 
-	data := userCollaboratorsFormat {
-		username, make([]userFormat, len(collaborators)),
+// Looks up a user in the graph. Entries are never modified once added, only replaced, so they are safe to read unlocked.
+func (srv *server) getUser(username string) (userEntry, bool) {
+	srv.graphMutex.RLock()
+	defer srv.graphMutex.RUnlock()
+	entry, ok := srv.collabGraph[username]
+	return entry, ok
+}
+
+// Whether the collaborators of a user are in the graph and were scanned recently enough to reuse
+func (srv *server) expanded(username string) bool {
+	entry, ok := srv.getUser(username)
+	return ok && entry.Collaborators != nil && srv.now().Sub(entry.Expanded) <= srv.expandTTL
+}
+
+// Replaces a users entry with the updated copy of it, adding them if they aren't in the graph
+func (srv *server) updateUser(username string, update func(entry *userEntry)) {
+	srv.graphMutex.Lock()
+	defer srv.graphMutex.Unlock()
+	entry := srv.collabGraph[username]
+	update(&entry)
+	srv.collabGraph[username] = entry
+	srv.dirtyUsers[username] = true
+}
+
+// Copies the graph so it can be traversed without holding graphMutex
+func (srv *server) graphSnapshot() map[string]userEntry {
+	srv.graphMutex.RLock()
+	defer srv.graphMutex.RUnlock()
+	graph := make(map[string]userEntry, len(srv.collabGraph))
+	for username, entry := range srv.collabGraph { graph[username] = entry }
+	return graph
+}
+
+// A repository linking a user to one of their collaborators
+type repoLink struct {
+	Repo string // In the form owner/name
+	Contributions int
+}
+
+// Measures the strength of a collaboration from the repositories linking the two users, 0 meaning no collaboration
+type weightFunc func(links []repoLink) float64
+
+// Weights collaborations by the total number of contributions made
+func contributionsWeight(links []repoLink) float64 {
+	total := 0
+	for _, link := range links { total += link.Contributions }
+	return float64(total)
+}
+
+// Weights collaborations by the log of the number of contributions made, so large projects don't dominate
+func logWeight(links []repoLink) float64 {
+	return math.Log1p(contributionsWeight(links))
+}
+
+// Weights every collaboration of at least min contributions equally and ignores the rest
+func thresholdWeight(min int) weightFunc {
+	return func(links []repoLink) float64 {
+		if contributionsWeight(links) < float64(min) { return 0 }
+		return 1
 	}
+}
 
-	// Get users data
-	for i, collaborator := range collaborators {
-		resp := srv.requestOK(w, auth, http.MethodGet, "https://api.github.com/users/" + collaborator)
-		if (resp.Status >= 400) { log.Printf("GET /users/%s returned %d", collaborator, resp.Status); return }
-		json.Unmarshal(resp.Body, &data.Collaborators[i])
+// Finds the weight function with the given name. Threshold weights use the minimum number of contributions.
+func parseWeight(name string, min int) (weightFunc, error) {
+	switch name {
+	case "", "log":
+		return logWeight, nil
+	case "contributions":
+		return contributionsWeight, nil
+	case "threshold":
+		return thresholdWeight(min), nil
 	}
+	return nil, fmt.Errorf("Unknown weight function: %s", name)
+}
+
+// Weight of the collaboration between two users in either direction
+func edgeWeight(graph map[string]userEntry, a, b string, weight weightFunc) float64 {
+	links := append(append([]repoLink{}, graph[a].Repos[b]...), graph[b].Repos[a]...)
+	return weight(links)
+}
+
+func (srv *server) sendUserCollaborators(ws *wsConn, auth, username string, collaborators []string) {
+	data, ok := srv.userCollaborators(auth, username, collaborators)
+	if !ok { return }
 
 	// Send data
 	if err := ws.WriteJSON(data); err != nil {
-		log.Printf("Unable to write data: %v", err)
+		warnf("Unable to write data: %v", err)
+	}
+}
+
+// Looks up the profiles of the collaborators of a user and the repositories linking them, returning false if any
+// profile couldn't be fetched
+func (srv *server) userCollaborators(auth, username string, collaborators []string) (userCollaboratorsFormat, bool) {
+
+	data := userCollaboratorsFormat {
+		username, make([]userFormat, len(collaborators)), map[string][]viaFormat{},
+	}
+	for _, collaborator := range collaborators {
+		data.Via[collaborator] = srv.linkingRepos(username, collaborator)
+	}
+
+	// Get users data in parallel
+	var failed int32
+	srv.parallel(len(collaborators), func(i int) {
+		if atomic.LoadInt32(&failed) != 0 { return }
+		resp, err := srv.request(auth, http.MethodGet, srv.apiURL + "/users/" + collaborators[i])
+		if err != nil {
+			warnf("GET /users/%s failed: %v", collaborators[i], err)
+			atomic.StoreInt32(&failed, 1)
+		} else if (resp.Status >= 400) {
+			warnf("GET /users/%s returned %d", collaborators[i], resp.Status)
+			atomic.StoreInt32(&failed, 1)
+		} else {
+			json.Unmarshal(resp.Body, &data.Collaborators[i])
+		}
+	})
+	return data, failed == 0
+}
+
+// Runs task(i) for every i in [0, n) on the servers bounded pool of workers and waits for them all to finish.
+// Tasks must not call parallel themselves.
+func (srv *server) parallel(n int, task func(i int)) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		srv.workers <- struct{}{}
+		go func(i int) {
+			defer func() { <-srv.workers; wg.Done() }()
+			task(i)
+		}(i)
 	}
+	wg.Wait()
 }
 
-func (srv *server) addCollaborators(w http.ResponseWriter, auth, username string) {
-	log.Printf("Scanning for collaborators of %s...", username)
+// A request GitHub answered with an error status
+type statusError struct {
+	Request string
+	Status int
+}
+
+func (err statusError) Error() string { return fmt.Sprintf("%s returned %d", err.Request, err.Status) }
+
+// Scans the repositories of a user for contributors and adds them to the graph as the users collaborators.
+// Nothing is added if the scan fails or is cut short, e.g. by errRateLimited, so it can be retried later.
+// Repositories whose contributors GitHub refuses to list are skipped, unless it failed or rejected the token.
+func (srv *server) addCollaborators(options requestOptions, username string) error {
+	infof("Scanning for collaborators of %s...", username)
 
 	// Find users repositories
-	resp := srv.requestOK(w, auth, http.MethodGet, "https://api.github.com/users/" + username + "/repos")
+	resp, err := srv.requestPages(options, http.MethodGet, srv.apiURL + "/users/" + username + "/repos")
+	if err != nil { return err }
 	if (resp.Status >= 400) {
-		srv.errorResponse(w, resp.Status)
-		log.Printf("GET /users/%s/repos returned %d", username, resp.Status)
+		warnf("GET /users/%s/repos returned %d", username, resp.Status)
+		return statusError { "GET /users/" + username + "/repos", resp.Status }
 	}
 
 	var repos reposFormat
 	json.Unmarshal(resp.Body, &repos)
 
-	// Find every contributor to every one of their repositories
-	collaborators := map[string]string{}
-	for _, repo := range repos {
-		resp = srv.requestOK(w, auth, http.MethodGet, "https://api.github.com/repos/" + username + "/" + repo.Name + "/contributors")
-		if (resp.Status >= 400) { log.Printf("GET /repos/%s/%s returned %d", username, repo.Name, resp.Status) }
-
-		var contributors contributorsFormat
-		json.Unmarshal(resp.Body, &contributors)
+	// Find every contributor to every one of their repositories in parallel
+	repoContributors := make([]contributorsFormat, len(repos))
+	errs := make([]error, len(repos))
+	var failed int32
+	srv.parallel(len(repos), func(i int) {
+		if atomic.LoadInt32(&failed) != 0 { return }
+		resp, err := srv.requestPages(options, http.MethodGet, srv.apiURL + "/repos/" + username + "/" + repos[i].Name + "/contributors")
+		if err != nil {
+			errs[i] = err
+			atomic.StoreInt32(&failed, 1)
+			return
+		}
+		if resp.Status >= 500 || resp.Status == http.StatusUnauthorized {
+			errs[i] = statusError { "GET /repos/" + username + "/" + repos[i].Name + "/contributors", resp.Status }
+			atomic.StoreInt32(&failed, 1)
+			return
+		}
+		if (resp.Status >= 400) { warnf("GET /repos/%s/%s returned %d", username, repos[i].Name, resp.Status) }
+		json.Unmarshal(resp.Body, &repoContributors[i])
+	})
+	for _, err := range errs {
+		if err != nil { return err }
+	}
 
+	collaborators := map[string][]repoLink{}
+	for i, contributors := range repoContributors {
 		for _, contributor := range contributors {
-			collaborators[contributor.Login] = repo.Name
+			link := repoLink { username + "/" + repos[i].Name, contributor.Contributions }
+			collaborators[contributor.Login] = append(collaborators[contributor.Login], link)
 		}
 	}
 
-	// Add these collaborators to the graph
-	// TODO: do something with repos
+	// Add these collaborators and the repositories linking them to the graph
 	keys := make([]string, 0, len(collaborators))
 	for k := range collaborators {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
-	entry := srv.collabGraph[username]
-	entry.Collaborators = keys
-	srv.collabGraph[username] = entry
+	srv.updateUser(username, func(entry *userEntry) {
+		entry.Collaborators = keys
+		entry.Repos = collaborators
+		entry.Expanded = srv.now()
+	})
+	return nil
 }
 
-func (srv *server) checkForTarget(collaborator string, username string, links map[string]string) {
-	log.Printf("Found a unique collaborator: %s is a contributor to a repo belonging to %s", collaborator, username)
-	/*
-	// if we're looking for a target and we find it
-	if collaborator == target {
-		path := []string { target }
-		for username != rootUsername {
-			path = append(path, username)
-			username = links[username]
-			// TODO: should remove username from links to prevent looping
-			// TODO: should username, ok := links[username]
-		}
+// Returns the path from the root of the links to the collaborator if they are the target being searched for
+func (srv *server) checkForTarget(target, collaborator string, links map[string]string) []string {
+	if target == "" || collaborator != target { return nil }
+	if _, ok := links[collaborator]; !ok { return nil }
+	infof("Found target %s", target)
 
-		// TODO: ws.WriteJSON()
+	path := []string{}
+	for username := collaborator; username != ""; username = links[username] {
+		path = append([]string { username }, path...)
 	}
-	*/
+	return path
 }
 
+// Sends the result of a search for the target along with the repositories linking each user on the path
+func (srv *server) sendTargetPath(ws *wsConn, target string, result pathResult, err error) {
+	data := targetFormat { target, len(result.Path) - 1, srv.hops(result.Path), result.Calls, "", nil, result.Cost }
+	if err != nil { data.Error = err.Error() }
+	if result.Weighted != nil { data.Weighted = srv.hops(result.Weighted) }
+
+	if err := ws.WriteJSON(data); err != nil {
+		warnf("Unable to write data: %v", err)
+	}
+}
+
+// Describes each user on a path with the repositories linking them to the previous user
+func (srv *server) hops(path []string) []hopFormat {
+	hops := make([]hopFormat, len(path))
+	for i, login := range path {
+		hops[i] = hopFormat { login, []viaFormat{} }
+		if i == 0 { continue }
+		hops[i].Via = srv.linkingRepos(path[i - 1], login)
+		if len(hops[i].Via) == 0 { hops[i].Via = srv.linkingRepos(login, path[i - 1]) }
+	}
+	return hops
+}
+
+// Finds the repositories of the owner the contributor has contributed to
+func (srv *server) linkingRepos(owner, contributor string) []viaFormat {
+	via := []viaFormat{}
+	entry, _ := srv.getUser(owner)
+	for _, link := range entry.Repos[contributor] {
+		via = append(via, viaFormat { link.Repo, link.Contributions })
+	}
+	return via
+}
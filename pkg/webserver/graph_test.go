@@ -2,9 +2,12 @@ package webserver
 
 import (
 	"testing"
-	"net/http"
-	"net/http/httptest"
 	"os"
+	"strings"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
 )
 
 func TestAddCollaborators(t *testing.T) {
@@ -17,19 +20,18 @@ func TestAddCollaborators(t *testing.T) {
 	t.Run("Attempt to add collaborators of invalid user", func(t *testing.T) {
 		srv, err := setupTestServer()
 		if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
-		rr := httptest.NewRecorder()
-		srv.addCollaborators(rr, pat, "not_a_real_username_so_this_should_error")
+		if err := srv.addCollaborators(requestOptions { Auth: pat }, "not_a_real_username_so_this_should_error"); err == nil {
+			t.Errorf("Expected error adding collaborators of not_a_real_username_so_this_should_error")
+		}
 		if _, ok := srv.collabGraph["edjohnso"]; ok {
 			t.Errorf("Added user entry for not_a_real_username_so_this_should_error")
 		}
-		assertResponseRecorder(t, rr, http.StatusNotFound, errorHTML)
 	})
 
 	t.Run("Add edjohnso collaborators", func(t *testing.T) {
 		srv, err := setupTestServer()
 		if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
-		rr := httptest.NewRecorder()
-		srv.addCollaborators(rr, pat, "edjohnso")
+		srv.addCollaborators(requestOptions { Auth: pat }, "edjohnso")
 		if entry, ok := srv.collabGraph["edjohnso"]; !ok {
 			t.Errorf("Failed to set user entry for edjohnso")
 		} else if entry.Collaborators == nil {
@@ -53,5 +55,132 @@ func TestAddCollaborators(t *testing.T) {
 func TestCheckForTarget(t *testing.T) {
 	srv, err := setupTestServer()
 	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
-	srv.checkForTarget("", "", nil)
+	links := map[string]string { "root": "", "a": "root", "b": "a", "c": "root" }
+
+	testCases := []struct { name string; target string; collaborator string; path []string } {
+		{ "No target", "", "b", nil },
+		{ "Not the target", "c", "b", nil },
+		{ "Target not linked", "d", "d", nil },
+		{ "Target is root", "root", "root", []string { "root" } },
+		{ "Target found", "b", "b", []string { "root", "a", "b" } },
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			path := srv.checkForTarget(testCase.target, testCase.collaborator, links)
+			if (path == nil) != (testCase.path == nil) || strings.Join(path, ",") != strings.Join(testCase.path, ",") {
+				t.Errorf("Expected path: %v - Actual path: %v", testCase.path, path)
+			}
+		})
+	}
+}
+
+func TestAddCollaboratorsOffline(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+	github := setupTestGitHub(t, testGitHubData {
+		"alice": { "foo": { "alice": 10, "bob": 3, "dave": 2 }, "bar": { "carol": 1 }, "baz": {} },
+		"bob": {},
+		"carol": {},
+		"dave": {},
+	})
+	srv.apiURL = github.URL
+
+	srv.addCollaborators(requestOptions { Auth: "token-alice" }, "alice")
+	entry, ok := srv.collabGraph["alice"]
+	if !ok {
+		t.Fatalf("Failed to set user entry for alice")
+	}
+	expected := []string { "alice", "bob", "carol", "dave" }
+	if strings.Join(entry.Collaborators, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected collaborators do not match. Expected: %v. Actual: %v", expected, entry.Collaborators)
+	}
+	expectedRepos := map[string][]repoLink {
+		"alice": { { "alice/foo", 10 } },
+		"bob": { { "alice/foo", 3 } },
+		"carol": { { "alice/bar", 1 } },
+		"dave": { { "alice/foo", 2 } },
+	}
+	if fmt.Sprint(entry.Repos) != fmt.Sprint(expectedRepos) {
+		t.Errorf("Expected repos do not match. Expected: %v. Actual: %v", expectedRepos, entry.Repos)
+	}
+}
+
+func TestSendUserCollaborators(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+	github := setupTestGitHub(t, testGitHubData { "a": {}, "b": {}, "c": {}, "d": {}, "e": {} })
+	srv.apiURL = github.URL
+	server, client := setupTestWebSocket(t)
+
+	expected := []string { "e", "c", "a", "d", "b" }
+	srv.sendUserCollaborators(&wsConn { Conn: server }, "", "root", expected)
+
+	var data userCollaboratorsFormat
+	if err := client.ReadJSON(&data); err != nil {
+		t.Fatalf("Unable to read collaborators: %v", err)
+	}
+	logins := []string{}
+	for _, collaborator := range data.Collaborators { logins = append(logins, collaborator.Login) }
+	if data.Username != "root" || strings.Join(logins, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected collaborators of root in order %v, actually received %v of %s", expected, logins, data.Username)
+	}
+	if len(data.Via) != len(expected) {
+		t.Errorf("Expected repositories linking each collaborator, actually received %v", data.Via)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+	srv.workers = make(chan struct{}, 3)
+
+	var running, peak int32
+	done := make([]bool, 20)
+	srv.parallel(len(done), func(i int) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) { break }
+		}
+		time.Sleep(time.Millisecond)
+		done[i] = true
+		atomic.AddInt32(&running, -1)
+	})
+
+	for i := range done {
+		if !done[i] { t.Errorf("Task %d did not run", i) }
+	}
+	if peak > 3 {
+		t.Errorf("Expected at most 3 tasks to run at once, actually ran %d", peak)
+	}
+}
+
+func TestWeights(t *testing.T) {
+	links := []repoLink { { "a/x", 3 }, { "a/y", 4 } }
+
+	testCases := []struct { name string; weight string; min int; expected float64; errorExpected bool } {
+		{ "Default", "", 0, math.Log1p(7), false },
+		{ "Contributions", "contributions", 0, 7, false },
+		{ "Log", "log", 0, math.Log1p(7), false },
+		{ "Threshold met", "threshold", 7, 1, false },
+		{ "Threshold not met", "threshold", 8, 0, false },
+		{ "Unknown", "foo", 0, 0, true },
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			weight, err := parseWeight(testCase.weight, testCase.min)
+			if testCase.errorExpected {
+				if err == nil { t.Errorf("An error was expected but none was returned") }
+				return
+			}
+			if err != nil {
+				t.Fatalf("An unexpected error occurred: %v", err)
+			}
+			if w := weight(links); w != testCase.expected {
+				t.Errorf("Expected weight: %f - Actual weight: %f", testCase.expected, w)
+			}
+		})
+	}
 }
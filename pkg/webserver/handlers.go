@@ -1,8 +1,9 @@
 package webserver
 
 import (
-	"log"
+	"context"
 	"sync"
+	"time"
 	"net/url"
 	"net/http"
 	"encoding/json"
@@ -13,63 +14,125 @@ import (
 type userCollaboratorsFormat struct {
 	Username string `json:"username"`
 	Collaborators []userFormat `json:"collaborators"`
+	Via map[string][]viaFormat `json:"via"` // Repositories of the user each collaborator contributed to
+}
+
+type viaFormat struct {
+	Repo string `json:"repo"`
+	Contributions int `json:"contributions"`
 }
 
 type rootFormat struct {
 	Root userFormat `json:"root"`
 }
 
+type targetFormat struct {
+	Target string `json:"target"`
+	Distance int `json:"distance"` // -1 if no path was found
+	Path []hopFormat `json:"path"`
+	Calls uint64 `json:"calls"`
+	Error string `json:"error,omitempty"`
+	Weighted []hopFormat `json:"weighted,omitempty"` // Path through the strongest collaborations
+	Cost float64 `json:"cost,omitempty"`
+}
+
+// A user on a path and the repositories linking them to the previous user on the path
+type hopFormat struct {
+	Login string `json:"login"`
+	Via []viaFormat `json:"via"`
+}
+
 type statusFormat struct {
 	Working bool `json:"working"`
 	Paused bool `json:"paused"`
 	Depth int `json:"depth"`
 	MaxDepth int `json:"max_depth"`
+	RateLimit int `json:"rate_limit"`
+	RateRemaining int `json:"rate_remaining"`
+	RateReset int64 `json:"rate_reset"`
+	RateLimited bool `json:"rate_limited"`
+	Finished bool `json:"finished"` // Every user reachable from the root has been scanned
+}
+
+// Maximum distance searched for by the shortest path command
+const maxPathDepth = 6
+
+// Most GitHub requests the shortest path command sends
+const maxPathCalls = 500
+
+// Number of scanned users queued for a WebSocket client before any more are dropped
+const subscriberBacklog = 256
+
+// A WebSocket connection which is safe for concurrent writers
+type wsConn struct {
+	*websocket.Conn
+	writeMutex sync.Mutex
+}
+
+func (ws *wsConn) WriteJSON(v interface{}) error {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	return ws.Conn.WriteJSON(v)
 }
 
 func (srv *server) wsHandler(w http.ResponseWriter, r *http.Request) {
 
-	// Get auth token from cookie
-	authCookie, err := r.Cookie("gho")
+	// Get auth token from session
+	auth, _, err := srv.sessionToken(r)
 	if err != nil {
-		log.Printf("Failed to get gho cookie: %v", err)
+		warnf("Failed to get session: %v", err)
 		srv.errorResponse(w, http.StatusUnauthorized)
 		return
 	}
-	auth := authCookie.Value
 
 	// Attempt to get this users details with their auth token
-	resp := srv.requestOK(w, auth, http.MethodGet, "https://api.github.com/user")
+	resp := srv.requestOK(w, auth, http.MethodGet, srv.apiURL + "/user")
 	if (resp.Status >= 400) {
-		log.Printf("GET /user returned %d", resp.Status)
+		warnf("GET /user returned %d", resp.Status)
 		srv.errorResponse(w, http.StatusUnauthorized)
 		return
 	}
 	var user userFormat
 	json.Unmarshal(resp.Body, &user)
 
-	// Add user to graph if not already
-	if _, ok := srv.collabGraph[user.Login]; !ok {
-		srv.collabGraph[user.Login] = userEntry { 99, []string{} }
-	}
-
 	// Upgrade HTTP connection to WS
 	var upgrader = websocket.Upgrader{}
-	ws, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WS upgrade error: %v", err)
+		warnf("WS upgrade error: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	ws := &wsConn { Conn: conn }
 	defer ws.Close()
 
+	// Let shutdown stop listening to the client and stop any shortest path search
+	searchCtx, stopSearches := context.WithCancel(context.Background())
+	finished, ok := srv.startCrawl(ws, func() {
+		ws.SetReadDeadline(time.Now())
+		stopSearches()
+	})
+	if !ok {
+		stopSearches()
+		closeWebSocket(ws, "Server is shutting down", time.Now().Add(time.Second))
+		return
+	}
+	defer finished()
+	var searches sync.WaitGroup
+	defer func() {
+		stopSearches()
+		searches.Wait()
+	}()
+
 	rootData := rootFormat { user }
 	ws.WriteJSON(rootData)
 
 	// Send any loaded collaborators up to requested depth using Breadth-First Traversal
-	log.Printf("Sending loaded collaborators to WebSocket client...")
+	state := srv.newCrawlState(user.Login)
+	infof("Sending loaded collaborators to WebSocket client...")
 	queue := []string { user.Login }
 	links := map[string]string { user.Login: "" }
-	for depth := 0; depth <= srv.collabGraph[user.Login].RequestedDepth && len(queue) != 0; depth++ {
+	for depth := 0; depth <= state.RequestedDepth && len(queue) != 0; depth++ {
 		for range queue {
 
 			// Dequeue next and send
@@ -77,7 +140,7 @@ func (srv *server) wsHandler(w http.ResponseWriter, r *http.Request) {
 			queue = queue[1:]
 
 			// Link and enqueue unique collaborators
-			if entry, ok := srv.collabGraph[username]; ok {
+			if entry, ok := srv.getUser(username); ok {
 				uniques := []string{}
 
 				for _, collaborator := range entry.Collaborators {
@@ -88,121 +151,198 @@ func (srv *server) wsHandler(w http.ResponseWriter, r *http.Request) {
 					}
 				}
 
-				srv.sendUserCollaborators(w, ws, auth, username, uniques)
+				srv.sendUserCollaborators(ws, auth, username, uniques)
 			}
 		}
 	}
 
-	// Sync variables
-	quit := false
-	paused := true
+	// Guards state, which the writer of crawl events reads too
 	m := &sync.Mutex{}
-	c := sync.NewCond(m)
-	depth := 0
-	working := false
 
-	// Listen for commands from client
-	go func() {
-		log.Printf("Listening for commands from WebSocket client...")
-		for {
-			var data struct { Data string `json:"command"` }
-			if err := ws.ReadJSON(&data); err != nil {
-				log.Printf("Unable to read data: %v", err)
-				c.L.Lock()
-				quit = true;
-				c.L.Unlock()
-				c.Signal()
-				return
-			}
-			c.L.Lock()
-			switch data.Data {
-			case "plus":
-				entry := srv.collabGraph[user.Login]
-				entry.RequestedDepth++
-				srv.collabGraph[user.Login] = entry
-			case "minus":
-				entry := srv.collabGraph[user.Login]
-				entry.RequestedDepth--
-				srv.collabGraph[user.Login] = entry
-			case "pause":
-				paused = true
-			case "continue":
-				paused = false
-			}
-			status := statusFormat { working, paused, depth, srv.collabGraph[user.Login].RequestedDepth }
-			ws.WriteJSON(status)
-			c.L.Unlock()
-			c.Signal()
-		}
-	}()
-
-	// Grow collaborators graph
-	queue = []string { user.Login }
-	links = map[string]string { user.Login: "" }
-	for depth = 0; len(queue) != 0; depth++ {
+	// Must be called with m locked
+	sendStatus := func() {
+		status := srv.crawlStatusFor(user.Login)
+		token := status.Token
+		if token == "" { token = auth }
+		limit := srv.rateLimitFor(token)
+		ws.WriteJSON(statusFormat {
+			status.Working, state.Paused, status.Depth, state.RequestedDepth,
+			limit.Limit, limit.Remaining, limit.Reset.Unix(),
+			!srv.rateLimitedUntil(token, srv.now()).IsZero(), status.Finished,
+		})
+	}
 
-		for range queue {
+	// Stop searching once the target has been linked, returning false if it hasn't been yet. Must be called with m locked.
+	foundTarget := func() bool {
+		path := srv.frontierPath(user.Login, state.Target)
+		if path == nil { return false }
+		srv.sendTargetPath(ws, state.Target, pathResult { Path: path }, nil)
+		state.Target, state.Paused = "", true
+		return true
+	}
 
-			// Wait until not paused and depth <= max depth
-			c.L.Lock()
-			for !quit && (paused || depth > srv.collabGraph[user.Login].RequestedDepth) {
-				log.Printf("Stopped search (Paused: %t, depth == %d).", paused, depth)
-				working = false
-				status := statusFormat { working, paused, depth, srv.collabGraph[user.Login].RequestedDepth }
-				ws.WriteJSON(status)
-				c.Wait()
+	// Follow the background crawl from this user, which carries on as deep as any of their tabs wants.
+	// The crawl only queues its events, which are written by their own goroutine so a slow client never holds it up.
+	// Status changes are merged, and scanned users are dropped if the client falls too far behind.
+	events := make(chan crawlEvent, subscriberBacklog)
+	statusChanged := make(chan struct{}, 1)
+	sub := &crawlSubscriber { depth: -1 }
+	sub.notify = func(event crawlEvent) {
+		if event.Username == "" {
+			select {
+			case statusChanged <- struct{}{}:
+			default:
 			}
-			working = true
-			status := statusFormat { working, paused, depth, srv.collabGraph[user.Login].RequestedDepth }
-			ws.WriteJSON(status)
-			c.L.Unlock()
-			if quit { break }
-
-			// Dequeue next username
-			username := queue[0]
-			queue = queue[1:]
-			srv.addCollaborators(w, auth, username)
-
-			// Link and enqueue unique collaborators
-			if entry, ok := srv.collabGraph[username]; ok {
-				uniques := []string{}
-
-				for _, collaborator := range entry.Collaborators {
-					//if collaborator == "exclude whoever" { continue }
-					if paused || depth > srv.collabGraph[user.Login].RequestedDepth || quit { break }
-					if _, ok = links[collaborator]; !ok {
-						links[collaborator] = username
-						queue = append(queue, collaborator)
-						uniques = append(uniques, collaborator)
-						srv.checkForTarget(collaborator, username, links)
+			return
+		}
+		select {
+		case events <- event:
+		default:
+			warnf("WebSocket client of %s is falling behind, dropped collaborators of %s", user.Login, event.Username)
+		}
+	}
+	// The crawl pauses itself once the target is linked, as the event linking them may have been dropped.
+	// Must be called with m locked.
+	checkTarget := func() {
+		if state.Target != "" && foundTarget() {
+			srv.pauseCrawl(user.Login, sub)
+			sendStatus()
+		}
+	}
+	writeEvent := func(event crawlEvent) {
+		m.Lock()
+		defer m.Unlock()
+		if event.Collaborators != nil && event.Depth <= state.RequestedDepth { ws.WriteJSON(event.Collaborators) }
+		checkTarget()
+	}
+	stopWriter, writerDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for {
+			select {
+			case event := <-events:
+				writeEvent(event)
+			case <-statusChanged:
+
+				// Users queued before the status changed are written first
+				for drained := false; !drained; {
+					select {
+					case event := <-events:
+						writeEvent(event)
+					default:
+						drained = true
 					}
 				}
-
-				srv.sendUserCollaborators(w, ws, auth, username, uniques)
+				m.Lock()
+				sendStatus()
+				checkTarget()
+				m.Unlock()
+			case <-stopWriter:
+				return
 			}
 		}
+	}()
+	srv.subscribeCrawl(user.Login, auth, sub)
+	defer srv.unsubscribeCrawl(user.Login, sub)
+
+	// Closing the connection stops any write the writer is stuck on
+	defer func() {
+		close(stopWriter)
+		ws.Close()
+		<-writerDone
+	}()
 
-		c.L.Lock()
-		status := statusFormat { working, paused, depth, srv.collabGraph[user.Login].RequestedDepth }
-		ws.WriteJSON(status)
-		c.L.Unlock()
-
-		if quit { break }
-
+	// Listen for commands from client
+	infof("Listening for commands from WebSocket client...")
+	m.Lock()
+	sendStatus()
+	m.Unlock()
+	cancelSearch := func() {} // Stops the running shortest path search
+	for {
+		var data struct {
+			Data string `json:"command"`
+			Login string `json:"login"`
+			Weight string `json:"weight"`
+			MinContributions int `json:"min_contributions"`
+		}
+		if err := ws.ReadJSON(&data); err != nil {
+			warnf("Unable to read data: %v", err)
+			break
+		}
+		m.Lock()
+		paused := false // Stops the crawl even for the tabs which have left
+		switch data.Data {
+		case "plus":
+			state.RequestedDepth++
+		case "minus":
+			if state.RequestedDepth > 0 { state.RequestedDepth-- }
+		case "pause":
+			state.Paused, paused = true, true
+			cancelSearch()
+		case "continue":
+			state.Paused = false
+		case "target":
+			state.Target = data.Login
+			state.Paused = state.Target == ""
+			if state.Target != "" { paused = foundTarget() }
+		case "path":
+			if data.Weight != "" { state.Weight, state.MinContributions = data.Weight, data.MinContributions }
+			cancelSearch()
+		case "save":
+			srv.savePrefs(user.Login, state.prefs())
+		case "refresh":
+			if data.Login != "" { srv.refreshCrawl(user.Login, data.Login) }
+		}
+		demand := state.RequestedDepth
+		if state.Paused { demand = -1 }
+		if paused { srv.pauseCrawl(user.Login, sub) } else { srv.setCrawlDemand(user.Login, sub, demand) }
+		if data.Data == "target" { srv.setCrawlTarget(user.Login, sub, state.Target) }
+		sendStatus()
+		weight, weightErr := parseWeight(state.Weight, state.MinContributions)
+		m.Unlock()
+
+		// Search for the shortest path from both ends when requested, while listening for further commands.
+		// A newer search or pausing stops it without an answer.
+		if data.Data == "path" && data.Login != "" {
+			var ctx context.Context
+			ctx, cancelSearch = context.WithCancel(searchCtx)
+			searches.Add(1)
+			go func(target string) {
+				defer searches.Done()
+				result, err := srv.shortestPath(ctx, auth, user.Login, target, pathOptions { maxPathDepth, maxPathCalls })
+				if ctx.Err() != nil { return }
+				if err != nil { warnf("Shortest path search for %s failed: %v", target, err) }
+				if err == nil { err = weightErr }
+				if err == nil { result.Weighted, result.Cost = srv.weightedShortestPath(user.Login, target, weight) }
+				srv.sendTargetPath(ws, target, result, err)
+			}(data.Login)
+		}
 	}
+	cancelSearch()
 
-	log.Printf("Closing WebSocket...")
+	infof("Closing WebSocket...")
 }
 
 func (srv *server) oauthHandler(w http.ResponseWriter, r *http.Request) {
 
+	// Only accept codes from logins this browser started
+	verifier, err := srv.checkLoginState(r)
+	setStateCookie(w, r, "")
+	if err != nil {
+		warnf("Rejected OAuth code: %v", err)
+		srv.loginResponse(w, r, http.StatusUnauthorized)
+		return
+	}
+
 	// Exchange OAuth code for user access token
 	resp := srv.requestOK(
 		w, "", http.MethodPost,
-		"https://github.com/login/oauth/access_token" +
-			"?client_id=" + srv.clientID +
-			"&client_secret=" + srv.clientSecret +
-			"&code=" + mux.Vars(r)["code"])
+		srv.oauthURL + "/login/oauth/access_token?" + url.Values {
+			"client_id": { srv.clientID },
+			"client_secret": { srv.clientSecret },
+			"code": { mux.Vars(r)["code"] },
+			"code_verifier": { verifier },
+		}.Encode())
 	if (resp.Status >= 400) {
 		srv.errorResponse(w, resp.Status)
 		return
@@ -211,37 +351,42 @@ func (srv *server) oauthHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse user access token from body
 	query, err := url.ParseQuery(string(resp.Body))
 	if err != nil {
-		log.Printf("Unable to parse exchange response body: %v", err)
+		warnf("Unable to parse exchange response body: %v", err)
 		srv.errorResponse(w, http.StatusInternalServerError)
 		return
 	} else if query.Has("error") || !query.Has("access_token") {
-		w.WriteHeader(http.StatusUnauthorized)
-		srv.unauthHandler(w, r)
+		srv.loginResponse(w, r, http.StatusUnauthorized)
+		return
+	}
+
+	// Hold the auth token in a new session and only give the client its ID
+	id, err := srv.newSession(query.Get("access_token"))
+	if err != nil {
+		warnf("Unable to start session: %v", err)
+		srv.errorResponse(w, http.StatusInternalServerError)
 		return
 	}
+	setSessionCookie(w, r, id)
 
-	// Add auth token cookie before redirecting
-	http.SetCookie(w, &http.Cookie { Name: "gho", Value: query.Get("access_token") })
+	// Clear the raw auth token cookie set by older versions
+	http.SetCookie(w, &http.Cookie { Name: "gho", MaxAge: -1 })
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func (srv *server) userHandler(w http.ResponseWriter, r *http.Request) {
 
-	// Get auth token from cookie
-	authCookie, err := r.Cookie("gho")
+	// Get auth token from session
+	auth, _, err := srv.sessionToken(r)
 	if err != nil {
-		log.Printf("Failed to get gho cookie: %v", err)
-		w.WriteHeader(http.StatusUnauthorized)
-		srv.unauthHandler(w, r)
+		warnf("Failed to get session: %v", err)
+		srv.loginResponse(w, r, http.StatusUnauthorized)
 		return
 	}
-	auth := authCookie.Value
 
 	// Attempt to get this users details with their auth token
-	resp := srv.requestOK(w, auth, http.MethodGet, "https://api.github.com/user")
+	resp := srv.requestOK(w, auth, http.MethodGet, srv.apiURL + "/user")
 	if resp.Status == http.StatusUnauthorized {
-		w.WriteHeader(http.StatusUnauthorized)
-		srv.unauthHandler(w, r)
+		srv.loginResponse(w, r, http.StatusUnauthorized)
 		return
 	} else if (resp.Status >= 400) {
 		srv.errorResponse(w, resp.Status)
@@ -249,16 +394,40 @@ func (srv *server) userHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// The client should establish a WebSocket connection upon receiving this
-	srv.executeTemplate(w, "graph.html", nil) // TODO: send some template data
+	srv.executeTemplate(w, "graph.html", struct { WebSocketURL string } { webSocketURL(r) })
 }
 
 func (srv *server) unauthHandler(w http.ResponseWriter, r *http.Request) {
-	srv.executeTemplate(w, "login.html", struct { ClientID string }{ srv.clientID })
+	// Keep the login this browser already started, so signing in from either of two open login pages works
+	if s, ok := srv.currentLoginState(r); ok {
+		srv.loginPage(w, http.StatusOK, s)
+		return
+	}
+	srv.loginResponse(w, r, http.StatusOK)
+}
+
+// Sends the login page with a freshly started login
+func (srv *server) loginResponse(w http.ResponseWriter, r *http.Request, status int) {
+	s, sealed, err := srv.newLoginState()
+	if err != nil {
+		warnf("Unable to start login: %v", err)
+		srv.errorResponse(w, http.StatusInternalServerError)
+		return
+	}
+	setStateCookie(w, r, sealed)
+	srv.loginPage(w, status, s)
+}
+
+func (srv *server) loginPage(w http.ResponseWriter, status int, s loginState) {
+	w.WriteHeader(status)
+	srv.executeTemplate(w, "login.html", struct { ClientID, OAuthURL, AuthorizeURL string }{
+		srv.clientID, srv.oauthURL, srv.authorizeURL(s),
+	})
 }
 
 func (srv *server) executeTemplate(w http.ResponseWriter, name string, data interface{}) {
 	if err := srv.templates.ExecuteTemplate(w, name, data); err != nil {
-		log.Printf("Failed to execute '%s' template: %v", name, err)
+		warnf("Failed to execute '%s' template: %v", name, err)
 		srv.errorResponse(w, http.StatusInternalServerError)
 	}
 }
@@ -5,6 +5,12 @@ import (
 	"net/http/httptest"
 	"net/http"
 	"os"
+	"html/template"
+	"fmt"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"time"
 	"github.com/gorilla/mux"
 )
 
@@ -19,32 +25,100 @@ func TestUnauthHandler(t *testing.T) {
 	router.ServeHTTP(rr, request)
 
 	assertResponseRecorder(t, rr, http.StatusOK, loginHTML)
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != stateCookie { t.Fatalf("Expected a login state cookie, actually received %v", cookies) }
+
+	// Viewing the login page again, e.g. from another tab, keeps the login already started
+	request = httptest.NewRequest(http.MethodGet, "/", nil)
+	request.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, request)
+	assertResponseRecorder(t, rr, http.StatusOK, loginHTML)
+	if cookies := rr.Result().Cookies(); len(cookies) != 0 { t.Errorf("Expected the login state to be kept, actually received %v", cookies) }
 }
 
 func TestOAuthHandler(t *testing.T) {
 	srv, err := setupTestServer()
 	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	github := setupTestGitHub(t, testGitHubData { "alice": {} })
+	srv.oauthURL = github.URL
+
+	// Each case tampers with the request GitHub redirects back with
+	testCases := []struct { name string; tamper func(*http.Request); status int } {
+		{ "Valid code", func(*http.Request) {}, http.StatusSeeOther },
+		{ "Invalid code", func(r *http.Request) {
+			query := r.URL.Query()
+			query.Set("code", "foo")
+			r.URL.RawQuery = query.Encode()
+		}, http.StatusUnauthorized },
+		{ "Missing state", func(r *http.Request) {
+			query := r.URL.Query()
+			query.Del("state")
+			r.URL.RawQuery = query.Encode()
+		}, http.StatusUnauthorized },
+		{ "State from another browser", func(r *http.Request) {
+			r.Header.Del("Cookie")
+		}, http.StatusUnauthorized },
+		{ "Forged state", func(r *http.Request) {
+			state := "forged"
+			query := r.URL.Query()
+			query.Set("state", state)
+			r.URL.RawQuery = query.Encode()
+			r.Header.Del("Cookie")
+			r.AddCookie(&http.Cookie { Name: stateCookie, Value: state })
+		}, http.StatusUnauthorized },
+		{ "State from another login", func(r *http.Request) {
+			_, sealed, _ := srv.newLoginState()
+			r.Header.Del("Cookie")
+			r.AddCookie(&http.Cookie { Name: stateCookie, Value: sealed })
+		}, http.StatusUnauthorized },
+		{ "Expired state", func(r *http.Request) {
+			sealed, _ := srv.sealLoginState(loginState { r.URL.Query().Get("state"), "", time.Now().Add(-time.Minute) })
+			r.Header.Del("Cookie")
+			r.AddCookie(&http.Cookie { Name: stateCookie, Value: sealed })
+		}, http.StatusUnauthorized },
+		{ "Wrong code verifier", func(r *http.Request) {
+			sealed, _ := srv.sealLoginState(loginState { r.URL.Query().Get("state"), "wrong", time.Now().Add(time.Minute) })
+			r.Header.Del("Cookie")
+			r.AddCookie(&http.Cookie { Name: stateCookie, Value: sealed })
+		}, http.StatusUnauthorized },
+		{ "Reused code", func(r *http.Request) {
+			srv.oauthHandler(httptest.NewRecorder(), mux.SetURLVars(r, map[string]string { "code": r.URL.Query().Get("code") }))
+		}, http.StatusUnauthorized },
+		{ "Reused state", func(r *http.Request) {
+			srv.oauthHandler(httptest.NewRecorder(), mux.SetURLVars(r, map[string]string { "code": r.URL.Query().Get("code") }))
 
-	// FIXME: I don't think it's possible to test a successful OAuth code exchange
-	//        so this is just testing if it can handle exchange failure
-	testCases := []struct { name string; code string; ok bool } {
-		{ "Invalid code", "foo", false },
-		//{ "Valid code", "TODO", true },
+			// Sign in to GitHub again with the same state, so only the state has been used before
+			cookie, _ := r.Cookie(stateCookie)
+			s, _ := srv.openLoginState(cookie.Value)
+			client := http.Client { CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse } }
+			resp, err := client.Get(srv.authorizeURL(s) + "&login=alice")
+			if err != nil { t.Fatalf("Unable to authorize: %v", err) }
+			resp.Body.Close()
+		}, http.StatusUnauthorized },
 	}
 
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
+			request := startTestLogin(t, srv, "alice")
+			testCase.tamper(request)
 			rr := httptest.NewRecorder()
-			request := httptest.NewRequest(http.MethodGet, "/?code=" + testCase.code, nil)
 			router := mux.NewRouter()
 			router.HandleFunc("/", srv.oauthHandler).Queries("code", "{code}")
 			router.ServeHTTP(rr, request)
 
-			var expectedStatus int
-			var expectedBody string
-			if testCase.ok { expectedStatus = http.StatusOK } else { expectedStatus = http.StatusUnauthorized }
-			if testCase.ok { expectedBody = graphHTML } else { expectedBody = loginHTML }
-			assertResponseRecorder(t, rr, expectedStatus, expectedBody)
+			if testCase.status != http.StatusSeeOther {
+				assertResponseRecorder(t, rr, testCase.status, loginHTML)
+				return
+			}
+			if rr.Code != testCase.status {
+				t.Errorf("Expected status: %d - Actual status: %d", testCase.status, rr.Code)
+			}
+			request = httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, cookie := range rr.Result().Cookies() { request.AddCookie(cookie) }
+			if token, _, err := srv.sessionToken(request); err != nil || token != "token-alice" {
+				t.Errorf("Expected session holding exchanged token, actually received %s (%v)", token, err)
+			}
 		})
 	}
 }
@@ -59,7 +133,7 @@ func TestHandleWSRequest(t *testing.T) {
 	}
 
 	testCases := []struct { name string; token string; addCookie bool; status int; body string } {
-		{ "No access token cookie", "", false, http.StatusUnauthorized, errorHTML },
+		{ "No session cookie", "", false, http.StatusUnauthorized, errorHTML },
 		{ "Invalid access token", "", true, http.StatusUnauthorized, errorHTML },
 		{ "Invalid WebSocket connection", pat, true, http.StatusBadRequest, "Bad Request" },
 		// TODO: testing Websocket connection
@@ -70,7 +144,7 @@ func TestHandleWSRequest(t *testing.T) {
 			rr := httptest.NewRecorder()
 			request := httptest.NewRequest(http.MethodGet, "/", nil)
 			if testCase.addCookie {
-				request.AddCookie(&http.Cookie { Name: "gho", Value: testCase.token })
+				addTestSessionCookie(t, srv, request, testCase.token)
 			}
 			router := mux.NewRouter()
 			router.HandleFunc("/", srv.wsHandler)
@@ -90,7 +164,7 @@ func TestHandleUserRequest(t *testing.T) {
 	}
 
 	testCases := []struct { name string; token string; addCookie bool; ok bool } {
-		{ "No access token cookie", "", false, false },
+		{ "No session cookie", "", false, false },
 		{ "Invalid access token", "", true, false },
 		{ "Valid access token (PAT)", pat, true, true },
 	}
@@ -100,7 +174,7 @@ func TestHandleUserRequest(t *testing.T) {
 			rr := httptest.NewRecorder()
 			request := httptest.NewRequest(http.MethodGet, "/", nil)
 			if testCase.addCookie {
-				request.AddCookie(&http.Cookie { Name: "gho", Value: testCase.token })
+				addTestSessionCookie(t, srv, request, testCase.token)
 			}
 			router := mux.NewRouter()
 			router.HandleFunc("/", srv.userHandler)
@@ -145,3 +219,145 @@ func TestExecuteTemplate(t *testing.T) {
 	srv.executeTemplate(rr, "login.html", nil)
 	assertResponseRecorder(t, rr, http.StatusOK, loginHTML)
 }
+
+func TestConfigurableEndpoints(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	github := setupTestGitHub(t, testGitHubData { "alice": {} })
+	srv.apiURL, srv.oauthURL = github.URL, github.URL
+
+	t.Run("Login page links to OAuth root", func(t *testing.T) {
+		templates := srv.templates
+		defer func() { srv.templates = templates }()
+		srv.templates = template.Must(template.New("login.html").Parse(`{{.OAuthURL}}`))
+		rr := httptest.NewRecorder()
+		srv.unauthHandler(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		assertResponseRecorder(t, rr, http.StatusOK, github.URL)
+	})
+
+	t.Run("OAuth code exchange", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		request := startTestLogin(t, srv, "alice")
+		router := mux.NewRouter()
+		router.HandleFunc("/", srv.oauthHandler).Queries("code", "{code}")
+		router.ServeHTTP(rr, request)
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("Expected status: %d - Actual status: %d", http.StatusSeeOther, rr.Code)
+		}
+		request = httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, cookie := range rr.Result().Cookies() { request.AddCookie(cookie) }
+		if token, _, err := srv.sessionToken(request); err != nil || token != "token-alice" {
+			t.Errorf("Expected session holding exchanged token, actually received %s (%v)", token, err)
+		}
+	})
+
+	t.Run("User page", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		addTestSessionCookie(t, srv, request, "token-alice")
+		srv.userHandler(rr, request)
+		assertResponseRecorder(t, rr, http.StatusOK, graphHTML)
+	})
+}
+
+func TestTargetSearch(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	github := setupTestGitHub(t, testGitHubData {
+		"alice": { "foo": { "alice": 5, "bob": 1 } },
+		"bob": { "bar": { "carol": 2 }, "qux": { "erin": 1 } },
+		"carol": { "baz": { "dave": 3 } },
+		"dave": {},
+		"erin": {},
+	})
+	srv.apiURL = github.URL
+
+	ws := dialTestWSHandler(t, srv, "token-alice")
+	if err := ws.WriteJSON(map[string]string { "command": "target", "login": "dave" }); err != nil {
+		t.Fatalf("Unable to send target command: %v", err)
+	}
+
+	var data targetFormat
+	readTestWSMessage(t, ws, "target", &data)
+	expected := []hopFormat {
+		{ "alice", []viaFormat{} },
+		{ "bob", []viaFormat { { "alice/foo", 1 } } },
+		{ "carol", []viaFormat { { "bob/bar", 2 } } },
+		{ "dave", []viaFormat { { "carol/baz", 3 } } },
+	}
+	if data.Target != "dave" || data.Distance != 3 || fmt.Sprint(data.Path) != fmt.Sprint(expected) {
+		t.Errorf("Expected path to dave: %v - Actual path to %s: %v (distance %d)", expected, data.Target, data.Path, data.Distance)
+	}
+
+	var status statusFormat
+	readTestWSMessage(t, ws, "paused", &status)
+	for !status.Paused { readTestWSMessage(t, ws, "paused", &status) }
+}
+
+func TestShortestPathCommand(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	srv.apiURL = setupTestGitHub(t, testGitHubData {
+		"alice": { "foo": { "bob": 1 } },
+		"bob": { "bar": { "carol": 2 } },
+		"carol": {},
+	}).URL
+
+	ws := dialTestWSHandler(t, srv, "token-alice")
+	if err := ws.WriteJSON(map[string]string { "command": "path", "login": "carol" }); err != nil {
+		t.Fatalf("Unable to send path command: %v", err)
+	}
+
+	var data targetFormat
+	readTestWSMessage(t, ws, "target", &data)
+	expected := []hopFormat { { "alice", []viaFormat{} }, { "bob", []viaFormat { { "alice/foo", 1 } } }, { "carol", []viaFormat { { "bob/bar", 2 } } } }
+	if data.Distance != 2 || fmt.Sprint(data.Path) != fmt.Sprint(expected) || data.Calls == 0 {
+		t.Errorf("Expected path to carol: %v - Actual path: %v (distance %d, %d calls)", expected, data.Path, data.Distance, data.Calls)
+	}
+	if fmt.Sprint(data.Weighted) != fmt.Sprint(expected) || data.Cost <= 0 {
+		t.Errorf("Expected weighted path to carol: %v - Actual weighted path: %v (cost %f)", expected, data.Weighted, data.Cost)
+	}
+}
+
+func TestShortestPathCommandStops(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+
+	// Alice has lots of collaborators, each slow to scan, and none of them lead to zed
+	data := testGitHubData { "alice": { "foo": {} } }
+	for i := 0; i < 40; i++ {
+		login := fmt.Sprint("user", i)
+		data["alice"]["foo"][login] = 1
+		data[login] = map[string]map[string]int { login: {} }
+	}
+	github, _ := url.Parse(setupTestGitHub(t, data).URL)
+	var requests int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(50 * time.Millisecond)
+		httputil.NewSingleHostReverseProxy(github).ServeHTTP(w, r)
+	}))
+	t.Cleanup(slow.Close)
+	srv.apiURL = slow.URL
+
+	ws := dialTestWSHandler(t, srv, "token-alice")
+	var status statusFormat
+	readTestWSMessage(t, ws, "paused", &status)
+	depth := status.MaxDepth
+	if err := ws.WriteJSON(map[string]string { "command": "path", "login": "zed" }); err != nil { t.Fatalf("Unable to send path command: %v", err) }
+	for atomic.LoadInt32(&requests) == 0 { time.Sleep(time.Millisecond) }
+
+	// Commands are still answered while the search runs
+	start := time.Now()
+	if err := ws.WriteJSON(map[string]string { "command": "plus" }); err != nil { t.Fatalf("Unable to send plus command: %v", err) }
+	for status.MaxDepth != depth + 1 { readTestWSMessage(t, ws, "paused", &status) }
+	if elapsed := time.Since(start); elapsed > time.Second { t.Errorf("Expected the plus command to be answered during the search, actually took %v", elapsed) }
+
+	// Shutdown stops the search
+	start = time.Now()
+	if !srv.shutdown(5 * time.Second) { t.Errorf("Expected the search to stop before the deadline") }
+	if elapsed := time.Since(start); elapsed > time.Second { t.Errorf("Expected the search to stop at once, actually took %v", elapsed) }
+	sent := atomic.LoadInt32(&requests)
+	time.Sleep(200 * time.Millisecond)
+	if atomic.LoadInt32(&requests) != sent { t.Errorf("Expected no requests after shutdown, actually %d more", atomic.LoadInt32(&requests) - sent) }
+}
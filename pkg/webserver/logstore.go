@@ -0,0 +1,321 @@
+package webserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Log files start with the magic header followed by their format version as a big-endian uint32, then records of
+//   crc32 uint32 | op uint8 | bucket length uint16 | key length uint32 | value length uint32 | bucket | key | value
+// where the checksum covers everything after it. Later records replace earlier ones with the same bucket and key.
+const logMagic = "torvalds-log\n"
+const logVersion = 1
+const logRecordHeader = 15
+
+const (
+	logPut = 1
+	logDelete = 2
+)
+
+// Rewrite the log once superseded records take up more than this and more than the live records
+const defaultCompactAt = 1 << 20
+
+// Where the value of a key lives within the log
+type logValue struct {
+	offset int64
+	size int
+	record int64 // Size of the whole record holding the value
+}
+
+// Appends every change to a log file, keeping only the location of each value in memory.
+// Superseded records are dropped by compacting the log in the background.
+type logStore struct {
+	mutex sync.Mutex
+	file string
+	f *os.File
+	size int64 // Offset the next record is appended at
+	index map[string]map[string]logValue
+	live int64 // Bytes of records in the index
+	compactAt int64
+	compacting bool
+	compactions sync.WaitGroup
+	readOnly bool // Never writes to the file, which another process may be appending to
+}
+
+func openLogStore(file string, readOnly bool) (*logStore, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly { flag = os.O_RDONLY }
+	f, err := os.OpenFile(file, flag, 0644)
+	if err != nil { return nil, err }
+	s := &logStore { file: file, f: f, index: map[string]map[string]logValue{}, compactAt: defaultCompactAt, readOnly: readOnly }
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Replays the log into the index. A record cut short by a crash while appending is truncated away, or just skipped if
+// the log is read-only, as it may be a record still being appended.
+func (s *logStore) load() error {
+	info, err := s.f.Stat()
+	if err != nil { return err }
+	if info.Size() == 0 {
+		header := appendLogHeader(nil)
+		s.size = int64(len(header))
+		if s.readOnly { return nil }
+		_, err := s.f.WriteAt(header, 0)
+		return err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(s.f, 0, info.Size()))
+	header := make([]byte, len(logMagic) + 4)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(logMagic)]) != logMagic {
+		return fmt.Errorf("%w: %s is not a cache log", errCorruptCache, s.file)
+	}
+	if version := binary.BigEndian.Uint32(header[len(logMagic):]); version != logVersion {
+		return fmt.Errorf("Cache log format version %d is not supported (%d)", version, logVersion)
+	}
+
+	s.size, err = replayLog(r, int64(len(header)), s.apply)
+	if errors.Is(err, errCorruptCache) && s.readOnly {
+		warnf("Skipping %d bytes of incomplete records in %s: %v", info.Size() - s.size, s.file, err)
+		return nil
+	}
+	if errors.Is(err, errCorruptCache) {
+		warnf("Truncating %d bytes of incomplete records from %s: %v", info.Size() - s.size, s.file, err)
+		return s.f.Truncate(s.size)
+	}
+	return err
+}
+
+func appendLogHeader(buf []byte) []byte {
+	version := make([]byte, 4)
+	binary.BigEndian.PutUint32(version, logVersion)
+	return append(append(buf, logMagic...), version...)
+}
+
+func encodeLogRecord(op byte, bucket, key string, value []byte) []byte {
+	rec := make([]byte, logRecordHeader, logRecordHeader + len(bucket) + len(key) + len(value))
+	rec[4] = op
+	binary.BigEndian.PutUint16(rec[5:], uint16(len(bucket)))
+	binary.BigEndian.PutUint32(rec[7:], uint32(len(key)))
+	binary.BigEndian.PutUint32(rec[11:], uint32(len(value)))
+	rec = append(append(append(rec, bucket...), key...), value...)
+	binary.BigEndian.PutUint32(rec, crc32.ChecksumIEEE(rec[4:]))
+	return rec
+}
+
+// Reads records from r, which starts at offset within the log, calling apply for each one in order.
+// Returns the offset after the last complete record, and errCorruptCache if an incomplete or damaged record follows it.
+func replayLog(r io.Reader, offset int64, apply func(op byte, bucket, key string, value logValue)) (int64, error) {
+	header := make([]byte, logRecordHeader)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, fmt.Errorf("%w: %v", errCorruptCache, err)
+		}
+		bucketSize, keySize := int(binary.BigEndian.Uint16(header[5:])), int(binary.BigEndian.Uint32(header[7:]))
+		valueSize := int(binary.BigEndian.Uint32(header[11:]))
+		body := make([]byte, bucketSize + keySize + valueSize)
+		if _, err := io.ReadFull(r, body); err != nil { return offset, fmt.Errorf("%w: %v", errCorruptCache, err) }
+
+		crc := crc32.NewIEEE()
+		crc.Write(header[4:])
+		crc.Write(body)
+		if crc.Sum32() != binary.BigEndian.Uint32(header) { return offset, fmt.Errorf("%w: checksum mismatch at %d", errCorruptCache, offset) }
+
+		record := int64(logRecordHeader + len(body))
+		value := logValue { offset + int64(logRecordHeader + bucketSize + keySize), valueSize, record }
+		apply(header[4], string(body[:bucketSize]), string(body[bucketSize:bucketSize + keySize]), value)
+		offset += record
+	}
+}
+
+// Points the index at a record, which must be the newest one for its key
+func (s *logStore) apply(op byte, bucket, key string, value logValue) {
+	if old, ok := s.index[bucket][key]; ok {
+		s.live -= old.record
+		delete(s.index[bucket], key)
+	}
+	if op != logPut { return }
+	if s.index[bucket] == nil { s.index[bucket] = map[string]logValue{} }
+	s.index[bucket][key] = value
+	s.live += value.record
+}
+
+// Must be called with mutex locked
+func (s *logStore) append(op byte, bucket, key string, value []byte) error {
+	rec := encodeLogRecord(op, bucket, key, value)
+	if _, err := s.f.WriteAt(rec, s.size); err != nil { return err }
+	s.apply(op, bucket, key, logValue { s.size + int64(len(rec) - len(value)), len(value), int64(len(rec)) })
+	s.size += int64(len(rec))
+	return nil
+}
+
+func (s *logStore) Get(bucket, key string) ([]byte, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	location, ok := s.index[bucket][key]
+	if !ok { return nil, false, nil }
+	value := make([]byte, location.size)
+	_, err := s.f.ReadAt(value, location.offset)
+	return value, err == nil, err
+}
+
+func (s *logStore) Put(bucket, key string, value []byte) error {
+	if s.readOnly { return errReadOnlyStore }
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.append(logPut, bucket, key, value)
+}
+
+func (s *logStore) Delete(bucket, key string) error {
+	if s.readOnly { return errReadOnlyStore }
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.index[bucket][key]; !ok { return nil }
+	return s.append(logDelete, bucket, key, nil)
+}
+
+func (s *logStore) Iterate(bucket string, fn func(key string, value []byte) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := make([]string, 0, len(s.index[bucket]))
+	for key := range s.index[bucket] { keys = append(keys, key) }
+	sort.Strings(keys)
+	for _, key := range keys {
+		location := s.index[bucket][key]
+		value := make([]byte, location.size)
+		if _, err := s.f.ReadAt(value, location.offset); err != nil { return err }
+		if err := fn(key, value); err != nil { return err }
+	}
+	return nil
+}
+
+// Syncs the log and starts compacting it if enough of it is superseded
+func (s *logStore) Flush() error {
+	if s.readOnly { return nil }
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.f.Sync(); err != nil { return err }
+	s.startCompaction()
+	return nil
+}
+
+// Must be called with mutex locked
+func (s *logStore) startCompaction() bool {
+	garbage := s.size - int64(len(logMagic) + 4) - s.live
+	if s.compacting || garbage <= s.compactAt || garbage <= s.live { return false }
+	s.compacting = true
+	s.compactions.Add(1)
+	go s.compact()
+	return true
+}
+
+// Writes the live records to a new log while appends carry on, then copies over anything appended meanwhile and
+// swaps the new log in
+func (s *logStore) compact() {
+	defer s.compactions.Done()
+	start := time.Now()
+
+	s.mutex.Lock()
+	f, end := s.f, s.size
+	index := make(map[string]map[string]logValue, len(s.index))
+	for bucket, keys := range s.index {
+		index[bucket] = make(map[string]logValue, len(keys))
+		for key, location := range keys { index[bucket][key] = location }
+	}
+	s.mutex.Unlock()
+
+	compacted, err := s.writeCompacted(f, end, index)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.compacting = false
+	if err == nil { err = compacted.swap(s, f, end) }
+	if err != nil {
+		warnf("Unable to compact %s: %v", s.file, err)
+		if compacted != nil {
+			compacted.f.Close()
+			os.Remove(compacted.f.Name())
+		}
+		return
+	}
+	infof("Compacted %s to %d bytes in %v.", s.file, s.size, time.Since(start))
+}
+
+// Writes the records in the index to a temporary log beside the log file.
+// The old log is only ever appended to, so its records can be read without holding the mutex.
+func (s *logStore) writeCompacted(f *os.File, end int64, index map[string]map[string]logValue) (*logStore, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(s.file), filepath.Base(s.file) + ".compact-*")
+	if err != nil { return nil, err }
+	compacted := &logStore { file: s.file, f: tmp, index: map[string]map[string]logValue{} }
+	w := bufio.NewWriter(tmp)
+	header := appendLogHeader(nil)
+	w.Write(header)
+	compacted.size = int64(len(header))
+
+	buckets := make([]string, 0, len(index))
+	for bucket := range index { buckets = append(buckets, bucket) }
+	sort.Strings(buckets)
+	for _, bucket := range buckets {
+		keys := make([]string, 0, len(index[bucket]))
+		for key := range index[bucket] { keys = append(keys, key) }
+		sort.Strings(keys)
+		for _, key := range keys {
+			location := index[bucket][key]
+			value := make([]byte, location.size)
+			if _, err := f.ReadAt(value, location.offset); err != nil { return compacted, err }
+			rec := encodeLogRecord(logPut, bucket, key, value)
+			if _, err := w.Write(rec); err != nil { return compacted, err }
+			compacted.apply(logPut, bucket, key, logValue { compacted.size + int64(len(rec) - len(value)), len(value), int64(len(rec)) })
+			compacted.size += int64(len(rec))
+		}
+	}
+	return compacted, w.Flush()
+}
+
+// Copies the records appended to the old log since end, then replaces the old log.
+// Must be called with the old stores mutex locked.
+func (compacted *logStore) swap(s *logStore, f *os.File, end int64) error {
+	if _, err := compacted.f.Seek(compacted.size, io.SeekStart); err != nil { return err }
+	if _, err := io.Copy(compacted.f, io.NewSectionReader(f, end, s.size - end)); err != nil { return err }
+	tail := io.NewSectionReader(compacted.f, compacted.size, s.size - end)
+	size, err := replayLog(bufio.NewReader(tail), compacted.size, compacted.apply)
+	if err != nil { return err }
+	compacted.size = size
+
+	if err := compacted.f.Sync(); err != nil { return err }
+	if err := os.Rename(compacted.f.Name(), s.file); err != nil { return err }
+	if d, err := os.Open(filepath.Dir(s.file)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	f.Close()
+	s.f, s.size, s.index, s.live = compacted.f, compacted.size, compacted.index, compacted.live
+	return nil
+}
+
+// Waits for any compaction to finish, then syncs and closes the log
+func (s *logStore) Close() error {
+	s.compactions.Wait()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.readOnly { return s.f.Close() }
+	if err := s.f.Sync(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
@@ -0,0 +1,91 @@
+package webserver
+
+import (
+	"testing"
+	"path/filepath"
+	"os"
+	"fmt"
+)
+
+func TestLogStoreCompaction(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache.log")
+	store, err := openLogStore(file, false)
+	if err != nil { t.Fatalf("Unable to open log: %v", err) }
+	store.compactAt = 0
+
+	// Overwrite the same keys until most of the log is superseded
+	for i := 0; i < 20; i++ {
+		for _, key := range []string { "a", "b", "c" } {
+			store.Put("bucket", key, []byte(fmt.Sprintf("%s%d", key, i)))
+		}
+	}
+	store.Delete("bucket", "c")
+	before := store.size
+
+	// Start compacting and keep writing while it runs
+	store.mutex.Lock()
+	if !store.startCompaction() { t.Fatalf("Expected compaction to start") }
+	store.mutex.Unlock()
+	store.Put("bucket", "d", []byte("d"))
+	store.Put("bucket", "a", []byte("a20"))
+	store.compactions.Wait()
+
+	if store.size >= before {
+		t.Errorf("Expected log to shrink from %d bytes, actually %d bytes", before, store.size)
+	}
+	assertValues := func(store *logStore) {
+		for key, expected := range map[string]string { "a": "a20", "b": "b19", "d": "d" } {
+			if value, ok, err := store.Get("bucket", key); err != nil || !ok || string(value) != expected {
+				t.Errorf("Expected %s: %s - Actual %s: %s (%v)", key, expected, key, value, err)
+			}
+		}
+		if _, ok, _ := store.Get("bucket", "c"); ok {
+			t.Errorf("Expected deleted key to stay deleted after compaction")
+		}
+	}
+	assertValues(store)
+
+	if err := store.Close(); err != nil { t.Fatalf("Unable to close log: %v", err) }
+	if entries, _ := os.ReadDir(filepath.Dir(file)); len(entries) != 1 {
+		t.Errorf("Expected only the log file to be left, actually found %v", entries)
+	}
+	store, err = openLogStore(file, false)
+	if err != nil { t.Fatalf("Unable to reopen log: %v", err) }
+	defer store.Close()
+	assertValues(store)
+}
+
+func TestLogStoreIncompleteRecord(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache.log")
+	store, err := openLogStore(file, false)
+	if err != nil { t.Fatalf("Unable to open log: %v", err) }
+	store.Put("bucket", "a", []byte("a"))
+	store.Close()
+
+	// A crash part way through appending leaves part of a record behind
+	record := encodeLogRecord(logPut, "bucket", "b", []byte("b"))
+	f, err := os.OpenFile(file, os.O_APPEND | os.O_WRONLY, 0644)
+	if err != nil { t.Fatalf("Unable to open %s: %v", file, err) }
+	f.Write(record[:len(record) - 1])
+	f.Close()
+
+	store, err = openLogStore(file, false)
+	if err != nil { t.Fatalf("Expected incomplete record to be truncated, actually received: %v", err) }
+	defer store.Close()
+	if value, ok, _ := store.Get("bucket", "a"); !ok || string(value) != "a" {
+		t.Errorf("Expected complete records to be kept, actually received: %s", value)
+	}
+	if _, ok, _ := store.Get("bucket", "b"); ok {
+		t.Errorf("Expected incomplete record to be dropped")
+	}
+	store.Put("bucket", "c", []byte("c"))
+	if value, ok, _ := store.Get("bucket", "c"); !ok || string(value) != "c" {
+		t.Errorf("Expected records to be appended after truncation, actually received: %s", value)
+	}
+
+	// Files which aren't logs are corrupt caches
+	if err := os.WriteFile(file, []byte("not a log"), 0644); err != nil { t.Fatalf("Unable to write %s: %v", file, err) }
+	if _, err := openLogStore(file, false); err == nil {
+		t.Errorf("Expected error when opening a file which isn't a log")
+	}
+}
@@ -0,0 +1,58 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// A Torvalds Number lookup from outside the server, sharing its cache file
+type PathQuery struct {
+	Token string // Personal access token GitHub is queried with
+	Source string
+	Target string
+	Cache string // Cache file of the server, updated with whatever the lookup scans unless it's offline
+	APIURL string
+	MaxDepth int // Longest path searched for, 0 is unlimited
+	MaxRequests uint64 // Most GitHub requests sent, 0 is unlimited
+	Offline bool // Answer from the cache alone, however stale, without sending any requests
+}
+
+type PathAnswer struct {
+	Path []string // Users from the source to the target, empty if no path was found
+	Distance int // Torvalds Number of the source and target, -1 if no path was found
+	Requests uint64 // GitHub requests sent
+}
+
+// Returned by FindPath once MaxRequests have been sent without finding a path
+var ErrRequestBudget = errPathBudget
+
+var errOffline = errors.New("Offline, only cached responses are available")
+
+// Finds a shortest path of collaborators between two users, reusing the collaborators and responses in the cache
+func FindPath(query PathQuery) (PathAnswer, error) {
+	answer := PathAnswer { Distance: -1 }
+	if query.Token == "" && !query.Offline { return answer, errors.New("Looking up users on GitHub needs a personal access token") }
+
+	srv := newServer()
+	srv.apiURL = strings.TrimSuffix(query.APIURL, "/")
+	srv.offline = query.Offline
+	if srv.offline {
+		if _, err := os.Stat(query.Cache); errors.Is(err, os.ErrNotExist) { return answer, nil }
+		srv.expandTTL = time.Duration(1<<63 - 1)
+	}
+	if err := srv.loadCache(query.Cache); err != nil { return answer, err }
+
+	result, err := srv.shortestPath(context.Background(), query.Token, query.Source, query.Target, pathOptions { query.MaxDepth, query.MaxRequests })
+	answer.Requests = result.Calls
+	if len(result.Path) != 0 { answer.Path, answer.Distance = result.Path, len(result.Path) - 1 }
+
+	// Keep what was scanned for the server and later lookups. Offline lookups opened the cache read-only.
+	if !srv.offline {
+		if _, _, saveErr := srv.saveCache(); saveErr != nil { warnf("Error while writing to cache: %v", saveErr) }
+	}
+	if closeErr := srv.store.Close(); closeErr != nil { warnf("Error while closing cache: %v", closeErr) }
+	return answer, err
+}
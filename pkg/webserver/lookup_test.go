@@ -0,0 +1,129 @@
+package webserver
+
+import (
+	"testing"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+func TestFindPath(t *testing.T) {
+	github := setupTestGitHub(t, testGitHubData {
+		"alice": { "a": { "bob": 1 } },
+		"bob": { "b": { "carol": 1 } },
+		"carol": {},
+		"dave": {},
+	})
+	cache := filepath.Join(t.TempDir(), "cache.gz")
+	query := PathQuery { Token: "token-alice", Source: "alice", Target: "carol", Cache: cache, APIURL: github.URL + "/" }
+
+	// Scans are saved to the cache, so answering again offline sends no requests
+	for _, offline := range []bool { false, true } {
+		query.Offline = offline
+		answer, err := FindPath(query)
+		if err != nil { t.Fatalf("Unable to find path (offline: %t): %v", offline, err) }
+		if fmt.Sprint(answer.Path) != "[alice bob carol]" || answer.Distance != 2 {
+			t.Errorf("Expected distance 2 through bob (offline: %t), actually %d through %v", offline, answer.Distance, answer.Path)
+		}
+		if offline && answer.Requests != 0 { t.Errorf("Expected no requests offline, actually sent %d", answer.Requests) }
+	}
+	github.Close()
+
+	testCases := []struct {
+		name string
+		query PathQuery
+		distance int
+		err error
+	}{
+		{ "Offline without cache", PathQuery { Source: "alice", Target: "carol", Cache: filepath.Join(t.TempDir(), "cache.gz"), Offline: true }, -1, nil },
+		{ "Offline unknown user", PathQuery { Source: "alice", Target: "dave", Cache: cache, Offline: true }, -1, nil },
+		{ "Beyond max depth", PathQuery { Source: "alice", Target: "carol", Cache: cache, Offline: true, MaxDepth: 1 }, -1, nil },
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			answer, err := FindPath(testCase.query)
+			if !errors.Is(err, testCase.err) || answer.Distance != testCase.distance {
+				t.Errorf("Expected distance %d and error %v, actually %d and %v", testCase.distance, testCase.err, answer.Distance, err)
+			}
+			if _, err := os.Stat(testCase.query.Cache); testCase.query.Cache != cache && !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Expected offline lookup not to create the cache file")
+			}
+		})
+	}
+
+	t.Run("Max requests", func(t *testing.T) {
+		// Scanning alice lists her repositories and the contributors of each at once
+		github, _ := url.Parse(setupTestGitHub(t, testGitHubData {
+			"alice": { "a": { "bob": 1 }, "b": { "bob": 1 }, "c": { "bob": 1 }, "d": { "bob": 1 }, "e": { "bob": 1 } },
+			"bob": {},
+			"carol": {},
+		}).URL)
+		var received int32
+		counter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&received, 1)
+			httputil.NewSingleHostReverseProxy(github).ServeHTTP(w, r)
+		}))
+		defer counter.Close()
+
+		query := PathQuery { Token: "token-alice", Source: "alice", Target: "carol", Cache: filepath.Join(t.TempDir(), "cache.gz"), APIURL: counter.URL, MaxRequests: 2 }
+		answer, err := FindPath(query)
+		if !errors.Is(err, ErrRequestBudget) { t.Errorf("Expected request budget to be spent, actually received %v", err) }
+		if received := atomic.LoadInt32(&received); received != 2 || answer.Requests != 2 {
+			t.Errorf("Expected 2 requests to reach GitHub, actually %d reached it and %d were counted", received, answer.Requests)
+		}
+	})
+	t.Run("Missing token", func(t *testing.T) {
+		if _, err := FindPath(PathQuery { Source: "alice", Target: "carol", Cache: cache }); err == nil { t.Errorf("Expected error without a token") }
+	})
+}
+
+func TestFindPathOfflineCache(t *testing.T) {
+	github := setupTestGitHub(t, testGitHubData { "alice": { "a": { "bob": 1 } }, "bob": {} })
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "cache.log")
+	if _, err := FindPath(PathQuery { Token: "token-alice", Source: "alice", Target: "bob", Cache: logFile, APIURL: github.URL }); err != nil {
+		t.Fatalf("Unable to find path: %v", err)
+	}
+
+	// A server part way through appending a record to its log
+	record := encodeLogRecord(logPut, usersBucket, "carol", []byte("carol"))
+	f, err := os.OpenFile(logFile, os.O_APPEND | os.O_WRONLY, 0644)
+	if err != nil { t.Fatalf("Unable to open %s: %v", logFile, err) }
+	f.Write(record[:len(record) - 1])
+	f.Close()
+	emptyLog, corruptGob := filepath.Join(dir, "empty.log"), filepath.Join(dir, "corrupt.gz")
+	os.WriteFile(emptyLog, nil, 0644)
+	os.WriteFile(corruptGob, []byte("not a cache"), 0644)
+
+	testCases := []struct {
+		name string
+		file string
+		distance int
+		fails bool
+	}{
+		{ "Incomplete record", logFile, 1, false },
+		{ "Empty log", emptyLog, -1, false },
+		{ "Corrupt cache", corruptGob, -1, true },
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			before, _ := os.ReadFile(testCase.file)
+			answer, err := FindPath(PathQuery { Source: "alice", Target: "bob", Cache: testCase.file, Offline: true })
+			if (err != nil) != testCase.fails || answer.Distance != testCase.distance {
+				t.Errorf("Expected distance %d (fails: %t), actually %d and %v", testCase.distance, testCase.fails, answer.Distance, err)
+			}
+			if after, err := os.ReadFile(testCase.file); err != nil || string(after) != string(before) {
+				t.Errorf("Expected offline lookup to leave the cache as it was (%v)", err)
+			}
+		})
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.corrupt-*")); len(matches) != 0 {
+		t.Errorf("Expected the corrupt cache not to be moved aside, actually found %v", matches)
+	}
+}
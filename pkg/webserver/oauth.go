@@ -0,0 +1,136 @@
+package webserver
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const stateCookie = "oauth_state"
+const stateLifetime = 10 * time.Minute
+
+// A login started from the login page, waiting for GitHub to redirect back with a code. It's sealed in the state cookie
+// of the browser which started it, so the server only holds the states of logins which came back, until they expire.
+type loginState struct {
+	State string // Random OAuth state GitHub redirects back with
+	Verifier string // PKCE code verifier, only ever sent to GitHub with the code
+	Expires time.Time
+}
+
+func randomString(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil { return "", err }
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Encrypts and authenticates login states with the state key
+func (srv *server) stateCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(srv.stateKey)
+	if err != nil { return nil, err }
+	return cipher.NewGCM(block)
+}
+
+// Starts a login and returns it sealed for the state cookie
+func (srv *server) newLoginState() (loginState, string, error) {
+	var s loginState
+	state, err := randomString(16)
+	if err != nil { return s, "", err }
+	verifier, err := randomString(32)
+	if err != nil { return s, "", err }
+	s = loginState { state, verifier, time.Now().Add(stateLifetime) }
+	sealed, err := srv.sealLoginState(s)
+	return s, sealed, err
+}
+
+func (srv *server) sealLoginState(s loginState) (string, error) {
+	aead, err := srv.stateCipher()
+	if err != nil { return "", err }
+	plain, err := json.Marshal(s)
+	if err != nil { return "", err }
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil { return "", err }
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, []byte(stateCookie))), nil
+}
+
+// Opens a sealed login state, failing if it was forged, tampered with or has expired
+func (srv *server) openLoginState(sealed string) (loginState, error) {
+	var s loginState
+	aead, err := srv.stateCipher()
+	if err != nil { return s, err }
+	buf, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(buf) < aead.NonceSize() { return s, errors.New("Malformed OAuth state cookie") }
+	size := aead.NonceSize()
+	plain, err := aead.Open(nil, buf[:size], buf[size:], []byte(stateCookie))
+	if err != nil { return s, errors.New("Invalid OAuth state cookie") }
+	if err := json.Unmarshal(plain, &s); err != nil { return s, err }
+	if time.Now().After(s.Expires) { return s, errors.New("Expired OAuth state") }
+	return s, nil
+}
+
+// Where the login page sends the browser to sign in to GitHub
+func (srv *server) authorizeURL(s loginState) string {
+	challenge := sha256.Sum256([]byte(s.Verifier))
+	return srv.oauthURL + "/login/oauth/authorize?" + url.Values {
+		"client_id": { srv.clientID },
+		"state": { s.State },
+		"code_challenge": { base64.RawURLEncoding.EncodeToString(challenge[:]) },
+		"code_challenge_method": { "S256" },
+	}.Encode()
+}
+
+// Binds the sealed login state to the browser starting the login, or clears it if the state is empty
+func setStateCookie(w http.ResponseWriter, r *http.Request, sealed string) {
+	cookie := &http.Cookie {
+		Name: stateCookie,
+		Value: sealed,
+		Path: "/",
+		MaxAge: int(stateLifetime.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure: isHTTPS(r),
+	}
+	if sealed == "" { cookie.MaxAge = -1 }
+	http.SetCookie(w, cookie)
+}
+
+// Returns the login this browser already started, if it hasn't expired or been used
+func (srv *server) currentLoginState(r *http.Request) (loginState, bool) {
+	cookie, err := r.Cookie(stateCookie)
+	if err != nil { return loginState{}, false }
+	s, err := srv.openLoginState(cookie.Value)
+	if err != nil { return s, false }
+	srv.sessionMutex.Lock()
+	defer srv.sessionMutex.Unlock()
+	_, used := srv.usedStates[s.State]
+	return s, !used
+}
+
+// Returns the code verifier if the request came back with the state of the login this browser started.
+// A state can only be used once.
+func (srv *server) checkLoginState(r *http.Request) (string, error) {
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(stateCookie)
+	if err != nil { return "", errors.New("Missing OAuth state cookie") }
+	s, err := srv.openLoginState(cookie.Value)
+	if err != nil { return "", err }
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(s.State)) != 1 { return "", errors.New("OAuth state does not match this browser") }
+
+	// Remember used states until they expire, after which their cookies are rejected anyway
+	srv.sessionMutex.Lock()
+	defer srv.sessionMutex.Unlock()
+	now := time.Now()
+	for used, expires := range srv.usedStates {
+		if now.After(expires) { delete(srv.usedStates, used) }
+	}
+	if _, used := srv.usedStates[s.State]; used { return "", errors.New("OAuth state already used") }
+	srv.usedStates[s.State] = s.Expires
+	return s.Verifier, nil
+}
@@ -0,0 +1,182 @@
+package webserver
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// Limits on a shortest path search, zero meaning no limit
+type pathOptions struct {
+	MaxDepth int
+	MaxCalls uint64
+}
+
+type pathResult struct {
+	Path []string // Empty if no path was found
+	Calls uint64 // GitHub API requests sent during the search
+	Weighted []string // Path through the strongest collaborations, if requested
+	Cost float64 // Cost of the weighted path
+}
+
+// Links to search outwards from on one side of a bidirectional search
+type pathFrontier struct {
+	queue []string
+	links map[string]string
+	depths map[string]int
+	depth int
+}
+
+var errPathBudget = errors.New("API request budget for path search spent")
+
+// Finds a shortest path of collaborators between the source and the target with a Breadth-First Search from both ends.
+// Collaboration is symmetric, so each side follows both the contributors of a users repositories and the cached
+// owners of repositories the user contributed to. Users already scanned in collabGraph are reused without any requests.
+// Stops sending requests once the context is done.
+func (srv *server) shortestPath(ctx context.Context, auth, source, target string, options pathOptions) (pathResult, error) {
+	infof("Searching for shortest path from %s to %s...", source, target)
+	// Count only the requests this search sends, whatever else is being crawled meanwhile
+	var calls uint64
+	requests := requestOptions { Auth: auth, Calls: &calls, MaxCalls: options.MaxCalls, Context: ctx }
+	result := func(path []string) pathResult {
+		return pathResult { Path: path, Calls: atomic.LoadUint64(&calls) }
+	}
+
+	if source == target { return result([]string { source }), nil }
+
+	// Index the edges already in the graph in reverse
+	reverse := map[string][]string{}
+	addReverse := func(username string, entry userEntry) {
+		for _, collaborator := range entry.Collaborators {
+			reverse[collaborator] = append(reverse[collaborator], username)
+		}
+	}
+	for username, entry := range srv.graphSnapshot() { addReverse(username, entry) }
+
+	neighbours := func(username string) ([]string, error) {
+		if !srv.expanded(username) {
+			if err := ctx.Err(); err != nil { return nil, err }
+			if options.MaxCalls != 0 && atomic.LoadUint64(&calls) >= options.MaxCalls { return nil, errPathBudget }
+			err := srv.addCollaborators(requests, username)
+			if errors.Is(err, errRateLimited) || errors.Is(err, errPathBudget) { return nil, err }
+			if err := ctx.Err(); err != nil { return nil, err }
+			entry, _ := srv.getUser(username)
+			addReverse(username, entry)
+		}
+		entry, _ := srv.getUser(username)
+		return append(append([]string{}, entry.Collaborators...), reverse[username]...), nil
+	}
+
+	forward := &pathFrontier { []string { source }, map[string]string { source: "" }, map[string]int { source: 0 }, 0 }
+	backward := &pathFrontier { []string { target }, map[string]string { target: "" }, map[string]int { target: 0 }, 0 }
+	meeting, best := "", 0
+	for len(forward.queue) != 0 || len(backward.queue) != 0 {
+
+		// Edges are only discovered by scanning their owner, so a shorter path may still be hidden behind an
+		// unscanned user. Keep going until both sides have searched one level beyond the best path found.
+		if meeting != "" && forward.depth + backward.depth > best { break }
+		if options.MaxDepth != 0 && forward.depth + backward.depth > options.MaxDepth { break }
+
+		// Expand a whole level of the shallower side, or the side with fewer users to scan.
+		// Continue with one side alone if the other runs out, as its incoming edges may just be unknown.
+		this, other := forward, backward
+		if len(forward.queue) == 0 || (len(backward.queue) != 0 && (backward.depth < forward.depth ||
+			(backward.depth == forward.depth && len(backward.queue) < len(forward.queue)))) {
+			this, other = backward, forward
+		}
+		this.depth++
+		for levelSize := len(this.queue); levelSize > 0; levelSize-- {
+			username := this.queue[0]
+			this.queue = this.queue[1:]
+
+			collaborators, err := neighbours(username)
+			if err != nil { return result(nil), err }
+			for _, collaborator := range collaborators {
+				if _, ok := this.links[collaborator]; ok { continue }
+				this.links[collaborator] = username
+				this.depths[collaborator] = this.depth
+				this.queue = append(this.queue, collaborator)
+				if d, ok := other.depths[collaborator]; ok && (meeting == "" || this.depth + d < best) {
+					meeting, best = collaborator, this.depth + d
+				}
+			}
+		}
+	}
+
+	if meeting != "" && (options.MaxDepth == 0 || best <= options.MaxDepth) {
+		path := []string{}
+		for username := meeting; username != ""; username = forward.links[username] {
+			path = append([]string { username }, path...)
+		}
+		for username := backward.links[meeting]; username != ""; username = backward.links[username] {
+			path = append(path, username)
+		}
+		return result(path), nil
+	}
+
+	return result(nil), nil
+}
+
+// Finds the path between the source and the target through the strongest collaborations already in collabGraph
+// with Dijkstra's algorithm, where each collaboration costs the inverse of its weight. Sends no API requests.
+func (srv *server) weightedShortestPath(source, target string, weight weightFunc) ([]string, float64) {
+	graph := srv.graphSnapshot()
+	reverse := map[string][]string{}
+	for username, entry := range graph {
+		for _, collaborator := range entry.Collaborators {
+			reverse[collaborator] = append(reverse[collaborator], username)
+		}
+	}
+
+	costs := map[string]float64 { source: 0 }
+	links := map[string]string { source: "" }
+	done := map[string]bool{}
+	queue := &pathQueue { { source, 0 } }
+	for queue.Len() != 0 {
+		next := heap.Pop(queue).(pathQueueItem)
+		if done[next.username] { continue }
+		done[next.username] = true
+
+		if next.username == target {
+			path := []string{}
+			for username := target; username != ""; username = links[username] {
+				path = append([]string { username }, path...)
+			}
+			return path, next.cost
+		}
+
+		collaborators := append(append([]string{}, graph[next.username].Collaborators...), reverse[next.username]...)
+		for _, collaborator := range collaborators {
+			if done[collaborator] { continue }
+			w := edgeWeight(graph, next.username, collaborator, weight)
+			if w <= 0 { continue }
+			cost := next.cost + 1 / w
+			if c, ok := costs[collaborator]; !ok || cost < c {
+				costs[collaborator] = cost
+				links[collaborator] = next.username
+				heap.Push(queue, pathQueueItem { collaborator, cost })
+			}
+		}
+	}
+
+	return nil, 0
+}
+
+// Priority queue of users by path cost for Dijkstra's algorithm
+type pathQueueItem struct {
+	username string
+	cost float64
+}
+type pathQueue []pathQueueItem
+
+func (q pathQueue) Len() int { return len(q) }
+func (q pathQueue) Less(i, j int) bool { return q[i].cost < q[j].cost }
+func (q pathQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *pathQueue) Push(x interface{}) { *q = append(*q, x.(pathQueueItem)) }
+func (q *pathQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old) - 1]
+	*q = old[:len(old) - 1]
+	return item
+}
@@ -0,0 +1,143 @@
+package webserver
+
+import (
+	"testing"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+)
+
+func TestShortestPath(t *testing.T) {
+	data := testGitHubData {
+		"alice": { "foo": { "alice": 5, "bob": 1 } },
+		"bob": { "bar": { "carol": 2 } },
+		"carol": { "baz": { "dave": 3 } },
+		"dave": {},
+		"erin": { "qux": { "dave": 1 } },
+		"frank": { "quux": { "alice": 1, "erin": 1 } },
+		"gina": { "corge": { "alice": 1, "dave": 1 } },
+	}
+
+	testCases := []struct { name string; source string; target string; options pathOptions; path []string } {
+		{ "Same user", "alice", "alice", pathOptions{}, []string { "alice" } },
+		{ "Direct collaborator", "alice", "bob", pathOptions{}, []string { "alice", "bob" } },
+		{ "Forward path", "alice", "carol", pathOptions{}, []string { "alice", "bob", "carol" } },
+		{ "Through contributed repos", "dave", "frank", pathOptions{}, []string { "dave", "erin", "frank" } },
+		{ "Shortest of two paths", "alice", "dave", pathOptions{}, []string { "alice", "gina", "dave" } },
+		{ "Within max depth", "alice", "dave", pathOptions { MaxDepth: 2 }, []string { "alice", "gina", "dave" } },
+		{ "Beyond max depth", "alice", "dave", pathOptions { MaxDepth: 1 }, nil },
+		{ "Unknown user", "alice", "nobody", pathOptions{}, nil },
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			srv, err := setupTestServer()
+			if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+			srv.apiURL = setupTestGitHub(t, data).URL
+
+			// alice is only known to have contributed to the repos of frank and gina from earlier scans
+			srv.addCollaborators(requestOptions { Auth: "" }, "frank")
+			srv.addCollaborators(requestOptions { Auth: "" }, "gina")
+
+			result, err := srv.shortestPath(context.Background(), "", testCase.source, testCase.target, testCase.options)
+			if err != nil {
+				t.Fatalf("An unexpected error occurred: %v", err)
+			}
+			if strings.Join(result.Path, ",") != strings.Join(testCase.path, ",") {
+				t.Errorf("Expected path: %v - Actual path: %v", testCase.path, result.Path)
+			}
+		})
+	}
+}
+
+func TestShortestPathCalls(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+	srv.apiURL = setupTestGitHub(t, testGitHubData {
+		"alice": { "foo": { "bob": 1 }, "bar": { "bob": 1 } },
+		"bob": { "baz": { "carol": 1 } },
+		"carol": {},
+	}).URL
+
+	result, err := srv.shortestPath(context.Background(), "", "alice", "carol", pathOptions { MaxCalls: 1 })
+	if !errors.Is(err, errPathBudget) {
+		t.Errorf("Expected errPathBudget, actually received: %v", err)
+	}
+
+	result, err = srv.shortestPath(context.Background(), "", "alice", "carol", pathOptions{})
+	if err != nil || len(result.Path) != 3 || result.Calls == 0 {
+		t.Errorf("Expected a path of 3 users costing API calls, actually received %v costing %d calls (%v)", result.Path, result.Calls, err)
+	}
+
+	// Edges scanned by the first search are reused
+	result, err = srv.shortestPath(context.Background(), "", "alice", "carol", pathOptions { MaxCalls: 1 })
+	if err != nil || len(result.Path) != 3 || result.Calls != 0 {
+		t.Errorf("Expected a path of 3 users costing no API calls, actually received %v costing %d calls (%v)", result.Path, result.Calls, err)
+	}
+
+	// Requests sent for anyone else during a search aren't counted against it
+	srv, err = setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+	github, _ := url.Parse(setupTestGitHub(t, testGitHubData {
+		"alice": { "foo": { "bob": 1 } },
+		"bob": { "baz": { "carol": 1 } },
+		"carol": {},
+	}).URL)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(other.Close)
+	var sent uint64
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddUint64(&sent, 1)
+		srv.request("", http.MethodGet, fmt.Sprintf("%s/%d", other.URL, n))
+		httputil.NewSingleHostReverseProxy(github).ServeHTTP(w, r)
+	}))
+	t.Cleanup(proxy.Close)
+	srv.apiURL = proxy.URL
+	result, err = srv.shortestPath(context.Background(), "", "alice", "carol", pathOptions{})
+	if err != nil || len(result.Path) != 3 || result.Calls != atomic.LoadUint64(&sent) {
+		t.Errorf("Expected a path of 3 users costing %d API calls, actually received %v costing %d calls (%v)", atomic.LoadUint64(&sent), result.Path, result.Calls, err)
+	}
+}
+
+func TestWeightedShortestPath(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+	now := srv.now()
+	srv.collabGraph = map[string]userEntry {
+		"alice": { []string { "bob", "carol", "dave" }, map[string][]repoLink {
+			"bob": { { "alice/a", 1 } },
+			"carol": { { "alice/b", 50 }, { "alice/c", 50 } },
+			"dave": { { "alice/d", 1 } },
+		}, now },
+		"bob": { []string { "dave" }, map[string][]repoLink { "dave": { { "bob/e", 1 } } }, now },
+		"dave": { []string { "carol" }, map[string][]repoLink { "carol": { { "dave/f", 100 } } }, now },
+	}
+
+	testCases := []struct { name string; source string; target string; weight weightFunc; path []string; cost float64 } {
+		{ "Same user", "alice", "alice", contributionsWeight, []string { "alice" }, 0 },
+		{ "Strong over direct", "alice", "dave", contributionsWeight, []string { "alice", "carol", "dave" }, 0.02 },
+		{ "Reverse edges", "dave", "bob", contributionsWeight, []string { "dave", "bob" }, 1 },
+		{ "Threshold", "bob", "carol", thresholdWeight(10), nil, 0 },
+		{ "Threshold met", "alice", "dave", thresholdWeight(100), []string { "alice", "carol", "dave" }, 2 },
+		{ "Unknown user", "alice", "nobody", logWeight, nil, 0 },
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			path, cost := srv.weightedShortestPath(testCase.source, testCase.target, testCase.weight)
+			if strings.Join(path, ",") != strings.Join(testCase.path, ",") {
+				t.Errorf("Expected path: %v - Actual path: %v", testCase.path, path)
+			}
+			if math.Abs(cost - testCase.cost) > 1e-9 {
+				t.Errorf("Expected cost: %f - Actual cost: %f", testCase.cost, cost)
+			}
+		})
+	}
+}
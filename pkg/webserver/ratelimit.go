@@ -0,0 +1,59 @@
+package webserver
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GitHub API budget of a single auth token, as reported by its latest response
+type rateLimit struct {
+	Limit int
+	Remaining int
+	Reset time.Time
+}
+
+var errRateLimited = errors.New("GitHub API rate limit exceeded")
+
+// Records the rate limit headers of a GitHub response made with the given auth token
+func (srv *server) updateRateLimit(auth string, status int, header http.Header, now time.Time) {
+	srv.rateMutex.Lock()
+	defer srv.rateMutex.Unlock()
+
+	limit := srv.rateLimits[auth]
+	if n, err := strconv.Atoi(header.Get("X-RateLimit-Limit")); err == nil { limit.Limit = n }
+	if n, err := strconv.Atoi(header.Get("X-RateLimit-Remaining")); err == nil { limit.Remaining = n }
+	if n, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil { limit.Reset = time.Unix(n, 0) }
+
+	// Secondary rate limits ask us to back off for a number of seconds instead
+	if isRateLimitedResponse(status, header) {
+		limit.Remaining = 0
+		if n, err := strconv.Atoi(header.Get("Retry-After")); err == nil {
+			limit.Reset = now.Add(time.Duration(n) * time.Second)
+		} else if !limit.Reset.After(now) {
+			limit.Reset = now.Add(time.Minute)
+		}
+	}
+
+	srv.rateLimits[auth] = limit
+}
+
+func (srv *server) rateLimitFor(auth string) rateLimit {
+	srv.rateMutex.Lock()
+	defer srv.rateMutex.Unlock()
+	return srv.rateLimits[auth]
+}
+
+// Returns when the auth token may be used again, or the zero time if it has budget remaining
+func (srv *server) rateLimitedUntil(auth string, now time.Time) time.Time {
+	limit := srv.rateLimitFor(auth)
+	if limit.Remaining > 0 || !limit.Reset.After(now) { return time.Time{} }
+	return limit.Reset
+}
+
+// Whether a response was refused because the rate limit was exceeded
+func isRateLimitedResponse(status int, header http.Header) bool {
+	if status != http.StatusForbidden && status != http.StatusTooManyRequests { return false }
+	return header.Get("Retry-After") != "" || header.Get("X-RateLimit-Remaining") == "0"
+}
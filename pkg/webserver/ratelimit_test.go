@@ -0,0 +1,75 @@
+package webserver
+
+import (
+	"testing"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+)
+
+func TestUpdateRateLimit(t *testing.T) {
+	now := time.Unix(1000, 0)
+	reset := strconv.FormatInt(now.Add(time.Hour).Unix(), 10)
+
+	testCases := []struct { name string; status int; header map[string]string; remaining int; until time.Time } {
+		{ "No headers", http.StatusOK, map[string]string{}, 0, time.Time{} },
+		{ "Budget remaining", http.StatusOK, map[string]string { "X-RateLimit-Limit": "5000", "X-RateLimit-Remaining": "42", "X-RateLimit-Reset": reset }, 42, time.Time{} },
+		{ "Budget spent", http.StatusOK, map[string]string { "X-RateLimit-Limit": "5000", "X-RateLimit-Remaining": "0", "X-RateLimit-Reset": reset }, 0, now.Add(time.Hour) },
+		{ "Refused", http.StatusForbidden, map[string]string { "X-RateLimit-Remaining": "0", "X-RateLimit-Reset": reset }, 0, now.Add(time.Hour) },
+		{ "Retry after", http.StatusTooManyRequests, map[string]string { "Retry-After": "60" }, 0, now.Add(time.Minute) },
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			srv := newServer()
+			header := http.Header{}
+			for k, v := range testCase.header { header.Set(k, v) }
+			srv.updateRateLimit("token", testCase.status, header, now)
+			if remaining := srv.rateLimitFor("token").Remaining; remaining != testCase.remaining {
+				t.Errorf("Expected remaining: %d - Actual remaining: %d", testCase.remaining, remaining)
+			}
+			if until := srv.rateLimitedUntil("token", now); !until.Equal(testCase.until) {
+				t.Errorf("Expected limited until: %v - Actual limited until: %v", testCase.until, until)
+			}
+			if until := srv.rateLimitedUntil("other", now); !until.IsZero() {
+				t.Errorf("Expected other tokens to be unaffected, limited until: %v", until)
+			}
+		})
+	}
+}
+
+func TestRequestRateLimited(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+
+	calls := 0
+	testAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer testAPIServer.Close()
+	srv.apiURL = testAPIServer.URL
+
+	for i := 0; i < 2; i++ {
+		if _, err := srv.request("token", http.MethodGet, testAPIServer.URL + "/users/foo"); !errors.Is(err, errRateLimited) {
+			t.Errorf("Expected errRateLimited, actually received: %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected requests to stop once rate limited, but %d were sent", calls)
+	}
+	if len(srv.requestCache) != 0 {
+		t.Errorf("Expected refused requests not to be cached")
+	}
+
+	if err := srv.addCollaborators(requestOptions { Auth: "token" }, "foo"); !errors.Is(err, errRateLimited) {
+		t.Errorf("Expected errRateLimited, actually received: %v", err)
+	}
+	if _, ok := srv.collabGraph["foo"]; ok {
+		t.Errorf("Expected no collaborators to be recorded while rate limited")
+	}
+}
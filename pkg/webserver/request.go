@@ -1,11 +1,25 @@
 package webserver
 
 import (
+	"context"
 	"io"
+	"bytes"
+	"strings"
+	"net/url"
 	"net/http"
+	"encoding/json"
 	"time"
+	"sync/atomic"
+	"crypto/sha256"
+	"container/list"
+	"fmt"
+	"sort"
+	"encoding/hex"
 )
 
+// Largest page size GitHub allows for list endpoints
+const perPage = "100"
+
 type response struct {
 	Status int
 	Header http.Header
@@ -18,42 +32,146 @@ type requestCacheEntry struct {
 	Response response
 }
 
+// Limits on the request cache, zero meaning unlimited. The least recently used requests are evicted first.
+type cacheLimits struct {
+	MaxEntries int
+	MaxBytes int64
+	MaxAge time.Duration // Since the response was received or last revalidated
+}
+
+// Number of cached requests evicted for exceeding each limit
+type evictionStats struct {
+	Entries, Bytes, Age int
+}
+
+func (e evictionStats) String() string {
+	return fmt.Sprintf("%d (%d over the entry limit, %d over the size limit, %d too old)", e.Entries + e.Bytes + e.Age, e.Entries, e.Bytes, e.Age)
+}
+
+// An element of the least recently used list
+type lruItem struct {
+	key string
+	size int64
+}
+
+// Who a request is sent for
+type requestOptions struct {
+	Auth string
+	Calls *uint64 // Counts the requests sent to GitHub for them, updated atomically, if not nil
+	MaxCalls uint64 // Most requests counted in Calls, further requests failing with errPathBudget, 0 is unlimited
+	Context context.Context // Stops any further requests being sent once it's done, if not nil
+	Revalidate bool // Checks cached responses with GitHub however fresh they are, e.g. to refresh a user
+}
+
+// A request being sent which identical requests wait on instead of sending their own
+type inflightRequest struct {
+	done chan struct{}
+	resp response
+	err error
+}
+
+// Paths of GitHub resources which are the same whichever token requests them
+var publicPaths = []string { "/users/", "/repos/" }
+
+func (srv *server) isPublicURL(url string) bool {
+	if !strings.HasPrefix(url, srv.apiURL + "/") { return false }
+	path := strings.TrimPrefix(url, srv.apiURL)
+	for _, prefix := range publicPaths {
+		if strings.HasPrefix(path, prefix) { return true }
+	}
+	return false
+}
+
+// Builds the key a request is cached under, or "" if it must not be cached.
+// Public resources are shared by every token and token-specific ones are keyed by a salted hash of the token,
+// so no token is ever held in the cache.
+func (srv *server) cacheKey(auth, method, url string) string {
+	if method != http.MethodGet { return "" }
+	if auth == "" || srv.isPublicURL(url) { return method + ":" + url }
+	hash := sha256.Sum256(append(append([]byte{}, srv.cacheSalt...), auth...))
+	return hex.EncodeToString(hash[:]) + ":" + method + ":" + url
+}
+
 func (srv *server) request(auth, method, url string) (response, error) {
-	srv.requestMutex.Lock()
-	defer srv.requestMutex.Unlock()
+	return srv.requestFor(requestOptions { Auth: auth }, method, url)
+}
 
-	now := time.Now()
-	key := auth + ":" + method + ":" + url
-	etag := ""
-
-	// Check if the request is cached
-	if entry, ok := srv.requestCache[key]; ok {
-		if now.Sub(entry.Time) > 24 * time.Hour { // TODO: check this works
-			etag = entry.ETag
-		} else {
-			r := entry.Response
-			r.Header = r.Header.Clone()
-			return r, nil
-		}
+// Requests from the cache if the cached response is fresh and isn't to be revalidated, otherwise from GitHub. Identical requests being sent for
+// anyone else are waited on rather than sent again, so they aren't counted in the options.
+func (srv *server) requestFor(options requestOptions, method, url string) (response, error) {
+	now := srv.now()
+	key := srv.cacheKey(options.Auth, method, url)
+	if key == "" { return srv.send(options, method, url, key, requestCacheEntry{}, false, now) }
+
+	// Check if the request is cached or already being sent
+	srv.requestMutex.Lock()
+	entry, cached := srv.requestCache[key]
+	if cached && srv.cacheLimits.MaxAge != 0 && now.Sub(entry.Time) > srv.cacheLimits.MaxAge {
+		srv.removeRequest(key)
+		srv.evictions.Age++
+		cached = false
+	}
+	if cached && (srv.offline || !options.Revalidate && now.Sub(entry.Time) <= srv.ttl(url, entry.Response)) {
+		srv.requestLRU.MoveToFront(srv.requestElements[key])
+		srv.requestMutex.Unlock()
+		return entry.Response.copy(), nil
+	}
+	if call, ok := srv.inflight[key]; ok {
+		srv.requestMutex.Unlock()
+		<-call.done
+		return call.resp.copy(), call.err
 	}
+	call := &inflightRequest { done: make(chan struct{}) }
+	srv.inflight[key] = call
+	srv.requestMutex.Unlock()
+
+	// Send the request without holding the lock
+	call.resp, call.err = srv.send(options, method, url, key, entry, cached, now)
+
+	srv.requestMutex.Lock()
+	delete(srv.inflight, key)
+	srv.requestMutex.Unlock()
+	close(call.done)
+	return call.resp.copy(), call.err
+}
+
+// Sends a request to GitHub, revalidating the stale cache entry if there is one, and caches the response
+func (srv *server) send(options requestOptions, method, url, key string, entry requestCacheEntry, cached bool, now time.Time) (response, error) {
 
-	// Otherwise, create a new request
+	if srv.offline { return response{}, errOffline }
+	auth := options.Auth
+
+	// Don't spend a request GitHub is going to refuse
+	if !srv.rateLimitedUntil(auth, now).IsZero() { return response{}, errRateLimited }
+
+	// Otherwise, create a new request, counting it before it's sent so parallel requests can't exceed the budget
 	req, err := http.NewRequest(method, url, nil)
 	if err != nil { return response{}, err }
+	if options.Context != nil && options.Context.Err() != nil { return response{}, options.Context.Err() }
+	if options.Calls != nil && atomic.AddUint64(options.Calls, 1) > options.MaxCalls && options.MaxCalls != 0 {
+		atomic.AddUint64(options.Calls, ^uint64(0))
+		return response{}, errPathBudget
+	}
 	// Add an auth token if provided
 	if auth != "" { req.Header.Add("Authorization", "token " + auth) }
 	// Add the ETag if the cached response is due a check
-	if etag != "" { req.Header.Add("If-None-Match", etag) }
+	if cached && entry.ETag != "" { req.Header.Add("If-None-Match", entry.ETag) }
 	// Send the request
 	var client http.Client
 	resp, err := client.Do(req)
 	if err != nil { return response{}, err }
+	defer resp.Body.Close()
+	atomic.AddUint64(&srv.apiCalls, 1)
+
+	// Track the remaining budget for this token and never cache refusals
+	srv.updateRateLimit(auth, resp.StatusCode, resp.Header, now)
+	if isRateLimitedResponse(resp.StatusCode, resp.Header) { return response{}, errRateLimited }
 
 	// If cached request is not modified, use the cached response
 	var r response
-	if resp.StatusCode == http.StatusNotModified {
-		r = srv.requestCache[key].Response
-		r.Header = r.Header.Clone()
+	etag := entry.ETag
+	if cached && resp.StatusCode == http.StatusNotModified {
+		r = entry.Response
 	} else {
 		body, err := io.ReadAll(resp.Body)
 		if err != nil { return response{}, err }
@@ -61,15 +179,161 @@ func (srv *server) request(auth, method, url string) (response, error) {
 		etag = resp.Header.Get("etag")
 	}
 
-	// Cache the request and return a copy
-	srv.requestCache[key] = requestCacheEntry { now, etag, r }
-	r = srv.requestCache[key].Response
-	r.Header = r.Header.Clone()
+	// Cache the request, unless GitHub failed or rejected the token, so retrying sends it again
+	if key == "" || r.Status >= 500 || r.Status == http.StatusUnauthorized { return r, nil }
+	srv.requestMutex.Lock()
+	srv.putRequest(key, requestCacheEntry { now, etag, r })
+	srv.evictRequests()
+	srv.requestMutex.Unlock()
 	return r, nil
 }
 
+// Estimates the memory held by a cached request
+func requestSize(key string, entry requestCacheEntry) int64 {
+	size := len(key) + len(entry.ETag) + len(entry.Response.Body)
+	for name, values := range entry.Response.Header {
+		size += len(name)
+		for _, value := range values { size += len(value) }
+	}
+	return int64(size)
+}
+
+// Caches the request as the most recently used. Must be called with requestMutex locked.
+func (srv *server) putRequest(key string, entry requestCacheEntry) {
+	if _, ok := srv.requestCache[key]; ok { srv.removeRequest(key) }
+	item := lruItem { key, requestSize(key, entry) }
+	srv.requestCache[key] = entry
+	srv.requestElements[key] = srv.requestLRU.PushFront(item)
+	srv.requestBytes += item.size
+	srv.dirtyRequests[key] = true
+}
+
+// Must be called with requestMutex locked
+func (srv *server) removeRequest(key string) {
+	if element, ok := srv.requestElements[key]; ok {
+		srv.requestBytes -= element.Value.(lruItem).size
+		srv.requestLRU.Remove(element)
+		delete(srv.requestElements, key)
+	}
+	delete(srv.requestCache, key)
+	srv.dirtyRequests[key] = true
+}
+
+// Evicts the least recently used requests until the cache is within its entry and size limits.
+// Must be called with requestMutex locked.
+func (srv *server) evictRequests() {
+	limits := srv.cacheLimits
+	for srv.requestLRU.Len() != 0 {
+		overEntries := limits.MaxEntries != 0 && srv.requestLRU.Len() > limits.MaxEntries
+		overBytes := limits.MaxBytes != 0 && srv.requestBytes > limits.MaxBytes
+		if overEntries { srv.evictions.Entries++ } else if overBytes { srv.evictions.Bytes++ } else { return }
+		srv.removeRequest(srv.requestLRU.Back().Value.(lruItem).key)
+	}
+}
+
+// Evicts every request older than the maximum age. Must be called with requestMutex locked.
+func (srv *server) evictExpiredRequests(now time.Time) {
+	if srv.cacheLimits.MaxAge == 0 { return }
+	for key, entry := range srv.requestCache {
+		if now.Sub(entry.Time) > srv.cacheLimits.MaxAge {
+			srv.removeRequest(key)
+			srv.evictions.Age++
+		}
+	}
+}
+
+// Rebuilds the least recently used list after the request cache is replaced, treating the most recently received
+// responses as the most recently used, then evicts requests over the limits
+func (srv *server) resetRequestLRU(now time.Time) {
+	srv.requestMutex.Lock()
+	defer srv.requestMutex.Unlock()
+	keys := make([]string, 0, len(srv.requestCache))
+	for key := range srv.requestCache { keys = append(keys, key) }
+	sort.Slice(keys, func(i, j int) bool { return srv.requestCache[keys[i]].Time.After(srv.requestCache[keys[j]].Time) })
+
+	srv.requestLRU.Init()
+	srv.requestElements = make(map[string]*list.Element, len(keys))
+	srv.requestBytes = 0
+	for _, key := range keys {
+		item := lruItem { key, requestSize(key, srv.requestCache[key]) }
+		srv.requestElements[key] = srv.requestLRU.PushBack(item)
+		srv.requestBytes += item.size
+	}
+	srv.evictExpiredRequests(now)
+	srv.evictRequests()
+}
+
+// Number of cached requests, their estimated size and how many have been evicted so far
+func (srv *server) requestCacheStats() (int, int64, evictionStats) {
+	srv.requestMutex.Lock()
+	defer srv.requestMutex.Unlock()
+	return len(srv.requestCache), srv.requestBytes, srv.evictions
+}
+
+// Copies the response so callers can't modify cached headers
+func (r response) copy() response {
+	r.Header = r.Header.Clone()
+	return r
+}
+
 func (srv *server) requestOK(w http.ResponseWriter, auth, method, url string) response {
 	resp, err := srv.request(auth, method, url)
 	if err != nil { srv.errorResponse(w, http.StatusInternalServerError) }
 	return resp
 }
+
+// Requests every page of a GitHub list endpoint by following rel="next" Link headers.
+// Each page is requested (and cached) individually and their JSON arrays are merged into the returned body.
+// If any page fails, that page's response is returned instead.
+func (srv *server) requestPages(options requestOptions, method, url string) (response, error) {
+	url, err := withPerPage(url)
+	if err != nil { return response{}, err }
+
+	var merged response
+	items := []json.RawMessage{}
+	for page := 0; url != ""; page++ {
+		resp, err := srv.requestFor(options, method, url)
+		if err != nil { return response{}, err }
+		if resp.Status >= 400 { return resp, nil }
+		if page == 0 { merged = resp }
+
+		// Empty lists may be returned as 204 No Content
+		if len(bytes.TrimSpace(resp.Body)) != 0 {
+			var pageItems []json.RawMessage
+			if err := json.Unmarshal(resp.Body, &pageItems); err != nil { return response{}, err }
+			items = append(items, pageItems...)
+		}
+
+		url = nextPageURL(resp.Header)
+	}
+
+	merged.Header.Del("Link")
+	merged.Body, err = json.Marshal(items)
+	return merged, err
+}
+
+// Asks for the largest page size unless the URL already specifies one
+func withPerPage(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil { return "", err }
+	query := u.Query()
+	if !query.Has("per_page") {
+		query.Set("per_page", perPage)
+		u.RawQuery = query.Encode()
+	}
+	return u.String(), nil
+}
+
+// Finds the rel="next" URL in a GitHub Link header, e.g. <https://...?page=2>; rel="next", <https://...?page=5>; rel="last"
+func nextPageURL(header http.Header) string {
+	for _, link := range strings.Split(header.Get("Link"), ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 { continue }
+		for _, param := range parts[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
@@ -5,6 +5,11 @@ import (
 	"net/http/httptest"
 	"net/http"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"encoding/json"
 )
 
 func TestRequestHandling(t *testing.T) {
@@ -124,3 +129,242 @@ func TestRequestOK(t *testing.T) {
 		})
 	}
 }
+
+func TestRequestPages(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+	github := setupTestGitHub(t, testGitHubData {
+		"alice": { "a": {}, "b": {}, "c": {}, "d": {}, "e": {} },
+		"bob": { "a": {} },
+		"carol": {},
+	})
+
+	testCases := []struct { name string; url string; status int; repos []string } {
+		{ "Multiple pages",  "/users/alice/repos", http.StatusOK,       []string { "a", "b", "c", "d", "e" } },
+		{ "Single page",     "/users/bob/repos",   http.StatusOK,       []string { "a" } },
+		{ "Empty list",      "/users/carol/repos", http.StatusOK,       []string {} },
+		{ "Error response",  "/users/dave/repos",  http.StatusNotFound, nil },
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			resp, err := srv.requestPages(requestOptions{}, http.MethodGet, github.URL + testCase.url)
+			if err != nil {
+				t.Fatalf("An unexpected error occurred: %v", err)
+			}
+			if resp.Status != testCase.status {
+				t.Errorf("Expected status: %d - Actual status: %d", testCase.status, resp.Status)
+			}
+			if testCase.repos == nil { return }
+			var repos reposFormat
+			if err := json.Unmarshal(resp.Body, &repos); err != nil {
+				t.Fatalf("Unable to decode merged body %s: %v", resp.Body, err)
+			}
+			names := []string{}
+			for _, repo := range repos { names = append(names, repo.Name) }
+			if strings.Join(names, ",") != strings.Join(testCase.repos, ",") {
+				t.Errorf("Expected repos: %v - Actual repos: %v", testCase.repos, names)
+			}
+			if link := resp.Header.Get("Link"); link != "" {
+				t.Errorf("Expected no Link header on merged response, actually received: %s", link)
+			}
+		})
+	}
+}
+
+func TestNextPageURL(t *testing.T) {
+	testCases := []struct { name string; link string; next string } {
+		{ "No header", "", "" },
+		{ "Next and last", `<https://api.github.com/x?page=2>; rel="next", <https://api.github.com/x?page=5>; rel="last"`, "https://api.github.com/x?page=2" },
+		{ "Last page", `<https://api.github.com/x?page=1>; rel="first", <https://api.github.com/x?page=4>; rel="prev"`, "" },
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set("Link", testCase.link)
+			if next := nextPageURL(header); next != testCase.next {
+				t.Errorf("Expected next: %s - Actual next: %s", testCase.next, next)
+			}
+		})
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+
+	var calls int64
+	release := make(chan struct{})
+	testAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		if r.URL.Path == "/slow" { <-release }
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer testAPIServer.Close()
+
+	// Identical requests share a single slow round trip
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := srv.request("", http.MethodGet, testAPIServer.URL + "/slow")
+			if err != nil {
+				t.Errorf("An unexpected error occurred: %v", err)
+				return
+			}
+			assertWebserverResponse(t, resp, http.StatusOK, "/slow")
+		}()
+	}
+
+	// Other requests aren't blocked by the slow one
+	done := make(chan struct{})
+	go func() {
+		resp, err := srv.request("", http.MethodGet, testAPIServer.URL + "/fast")
+		if err != nil {
+			t.Errorf("An unexpected error occurred: %v", err)
+		} else {
+			assertWebserverResponse(t, resp, http.StatusOK, "/fast")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Request was blocked by another in flight")
+	}
+
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt64(&calls); n != 2 {
+		t.Errorf("Expected 2 requests to be sent, actually sent %d", n)
+	}
+}
+
+func TestCacheKeys(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+
+	var calls int32
+	testAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		fmt.Fprintf(w, "%s %s", r.Header.Get("Authorization"), r.URL.Path)
+	}))
+	defer testAPIServer.Close()
+	srv.apiURL = testAPIServer.URL
+
+	testCases := []struct { name string; token string; method string; path string; body string; calls int32 } {
+		{ "Public resource",              "gho_alice", http.MethodGet,  "/users/carol", "token gho_alice /users/carol", 1 },
+		{ "Public resource, other token", "gho_bob",   http.MethodGet,  "/users/carol", "token gho_alice /users/carol", 1 },
+		{ "Token resource",               "gho_alice", http.MethodGet,  "/user",        "token gho_alice /user",        2 },
+		{ "Token resource, other token",  "gho_bob",   http.MethodGet,  "/user",        "token gho_bob /user",          3 },
+		{ "Token resource, same token",   "gho_alice", http.MethodGet,  "/user",        "token gho_alice /user",        3 },
+		{ "Non-GET request",              "gho_alice", http.MethodPost, "/user",        "token gho_alice /user",        4 },
+		{ "Non-GET request, same token",  "gho_alice", http.MethodPost, "/user",        "token gho_alice /user",        5 },
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			resp, err := srv.request(testCase.token, testCase.method, testAPIServer.URL + testCase.path)
+			if err != nil { t.Fatalf("An unexpected error occurred: %v", err) }
+			assertWebserverResponse(t, resp, http.StatusOK, testCase.body)
+			if n := atomic.LoadInt32(&calls); n != testCase.calls {
+				t.Errorf("Expected API calls: %d - Actual API calls: %d", testCase.calls, n)
+			}
+		})
+	}
+
+	// Tokens must never end up in the cache
+	for key := range srv.requestCache {
+		if strings.Contains(key, "gho_") { t.Errorf("Cache key contains an auth token: %s", key) }
+	}
+	if len(srv.requestCache) != 3 {
+		t.Errorf("Expected 3 cached requests, actually cached: %d", len(srv.requestCache))
+	}
+}
+
+func TestRequestCacheEviction(t *testing.T) {
+	testAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer testAPIServer.Close()
+
+	// Each case requests the paths in order and expects the remaining cached paths
+	testCases := []struct { name string; limits cacheLimits; paths []string; cached []string; evictions evictionStats } {
+		{ "Unlimited", cacheLimits{}, []string { "/a", "/b", "/c" }, []string { "/a", "/b", "/c" }, evictionStats{} },
+		{ "Entry limit", cacheLimits { MaxEntries: 2 }, []string { "/a", "/b", "/c" }, []string { "/b", "/c" }, evictionStats { Entries: 1 } },
+		{ "Least recently used", cacheLimits { MaxEntries: 2 }, []string { "/a", "/b", "/a", "/c" }, []string { "/a", "/c" }, evictionStats { Entries: 1 } },
+		{ "Size limit", cacheLimits { MaxBytes: 500 }, []string { "/a", "/b", "/c", "/d" }, []string { "/c", "/d" }, evictionStats { Bytes: 2 } },
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			srv, err := setupTestServer()
+			if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+			srv.cacheLimits = testCase.limits
+
+			for _, path := range testCase.paths {
+				if _, err := srv.request("", http.MethodGet, testAPIServer.URL + path); err != nil { t.Fatalf("Request failed: %v", err) }
+			}
+
+			cached := []string{}
+			for _, path := range []string { "/a", "/b", "/c", "/d" } {
+				if _, ok := srv.requestCache[srv.cacheKey("", http.MethodGet, testAPIServer.URL + path)]; ok { cached = append(cached, path) }
+			}
+			if fmt.Sprint(cached) != fmt.Sprint(testCase.cached) {
+				t.Errorf("Expected cached: %v - Actual cached: %v", testCase.cached, cached)
+			}
+			entries, bytes, evictions := srv.requestCacheStats()
+			if evictions != testCase.evictions {
+				t.Errorf("Expected evictions: %v - Actual evictions: %v", testCase.evictions, evictions)
+			}
+			if entries != len(srv.requestElements) || bytes > testCase.limits.MaxBytes && testCase.limits.MaxBytes != 0 {
+				t.Errorf("Cache of %d entries and %d bytes does not match the %d tracked entries", entries, bytes, len(srv.requestElements))
+			}
+		})
+	}
+
+	t.Run("Loaded cache", func(t *testing.T) {
+		srv, err := setupTestServer()
+		if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+		srv.cacheLimits = cacheLimits { MaxEntries: 1 }
+		now := time.Now()
+		for i, key := range []string { "new", "old", "older" } {
+			srv.requestCache[key] = requestCacheEntry { Time: now.Add(time.Duration(-i) * time.Minute) }
+		}
+
+		// The most recently received responses are kept
+		srv.resetRequestLRU(now)
+		if _, ok := srv.requestCache["new"]; !ok || len(srv.requestCache) != 1 {
+			t.Errorf("Expected only the newest request to be kept, actually kept: %v", srv.requestCache)
+		}
+	})
+
+	t.Run("Age limit", func(t *testing.T) {
+		srv, err := setupTestServer()
+		if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+		srv.cacheLimits = cacheLimits { MaxAge: time.Hour }
+		url := testAPIServer.URL + "/a"
+		srv.request("", http.MethodGet, url)
+		srv.request("", http.MethodGet, testAPIServer.URL + "/b")
+
+		// Age entries and check they're evicted when looked up and when swept
+		srv.requestMutex.Lock()
+		for key, entry := range srv.requestCache {
+			entry.Time = entry.Time.Add(-2 * time.Hour)
+			srv.requestCache[key] = entry
+		}
+		srv.requestMutex.Unlock()
+		srv.request("", http.MethodGet, url)
+		if _, _, evictions := srv.requestCacheStats(); evictions.Age != 1 {
+			t.Errorf("Expected 1 eviction by age on lookup, actually evicted: %v", evictions)
+		}
+		srv.requestMutex.Lock()
+		srv.evictExpiredRequests(time.Now())
+		srv.requestMutex.Unlock()
+		if entries, _, evictions := srv.requestCacheStats(); entries != 1 || evictions.Age != 2 {
+			t.Errorf("Expected only the refreshed request left after 2 evictions by age, actually %d left after %v", entries, evictions)
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package webserver
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const sessionCookie = "session"
+const sessionLifetime = 30 * 24 * time.Hour
+
+// A signed in user, identified by an opaque random ID held in their session cookie
+type session struct {
+	Token []byte // GitHub access token, encrypted if a session key is configured
+	Expires time.Time
+}
+
+// Parses the optional key used to encrypt access tokens held in sessions
+func loadSessionKey(encoded string) (cipher.AEAD, error) {
+	if encoded == "" {
+		infof("No session key provided, access tokens will be held unencrypted.")
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 { return nil, errors.New("The session key must be 32 bytes encoded in base64") }
+	block, err := aes.NewCipher(key)
+	if err != nil { return nil, err }
+	return cipher.NewGCM(block)
+}
+
+// Starts a session holding the access token and returns its ID
+func (srv *server) newSession(token string) (string, error) {
+	id, err := randomString(32)
+	if err != nil { return "", err }
+
+	sealed := []byte(token)
+	if srv.sessionCipher != nil {
+		nonce := make([]byte, srv.sessionCipher.NonceSize())
+		if _, err := rand.Read(nonce); err != nil { return "", err }
+		sealed = srv.sessionCipher.Seal(nonce, nonce, sealed, []byte(id))
+	}
+
+	srv.sessionMutex.Lock()
+	defer srv.sessionMutex.Unlock()
+	srv.sessions[id] = session { sealed, time.Now().Add(sessionLifetime) }
+	return id, nil
+}
+
+// Finds the access token of the session in the requests session cookie
+func (srv *server) sessionToken(r *http.Request) (string, string, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil { return "", "", err }
+	id := cookie.Value
+
+	srv.sessionMutex.Lock()
+	s, ok := srv.sessions[id]
+	if ok && time.Now().After(s.Expires) {
+		delete(srv.sessions, id)
+		ok = false
+	}
+	srv.sessionMutex.Unlock()
+	if !ok { return "", "", errors.New("Unknown or expired session") }
+
+	if srv.sessionCipher == nil { return string(s.Token), id, nil }
+	size := srv.sessionCipher.NonceSize()
+	if len(s.Token) < size { return "", "", errors.New("Malformed session token") }
+	token, err := srv.sessionCipher.Open(nil, s.Token[:size], s.Token[size:], []byte(id))
+	return string(token), id, err
+}
+
+func (srv *server) endSession(id string) {
+	srv.sessionMutex.Lock()
+	defer srv.sessionMutex.Unlock()
+	delete(srv.sessions, id)
+}
+
+// Sets the session cookie, or clears it if the ID is empty
+func setSessionCookie(w http.ResponseWriter, r *http.Request, id string) {
+	cookie := &http.Cookie {
+		Name: sessionCookie,
+		Value: id,
+		Path: "/",
+		MaxAge: int(sessionLifetime.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure: isHTTPS(r),
+	}
+	if id == "" { cookie.MaxAge = -1 }
+	http.SetCookie(w, cookie)
+}
+
+// Revokes the apps grant for the access token so it can't be used again
+func (srv *server) revokeToken(token string) error {
+	body, err := json.Marshal(struct { AccessToken string `json:"access_token"` } { token })
+	if err != nil { return err }
+	req, err := http.NewRequest(http.MethodDelete, srv.apiURL + "/applications/" + srv.clientID + "/grant", bytes.NewReader(body))
+	if err != nil { return err }
+	req.SetBasicAuth(srv.clientID, srv.clientSecret)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	var client http.Client
+	resp, err := client.Do(req)
+	if err != nil { return err }
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("DELETE /applications/%s/grant returned %d", srv.clientID, resp.StatusCode)
+	}
+	return nil
+}
+
+// Revokes the users access token, ends their session and returns them to the login page
+func (srv *server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if token, id, err := srv.sessionToken(r); err == nil {
+		if err := srv.revokeToken(token); err != nil { warnf("Failed to revoke access token: %v", err) }
+		srv.forgetCrawlToken(token)
+		srv.endSession(id)
+	}
+	setSessionCookie(w, r, "")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,106 @@
+package webserver
+
+import (
+	"testing"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+
+	testCases := []struct { name string; key string } {
+		{ "Unencrypted", "" },
+		{ "Encrypted", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=" },
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			srv, err := setupTestServer()
+			if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+			if srv.sessionCipher, err = loadSessionKey(testCase.key); err != nil { t.Fatalf("Failed to load session key: %v", err) }
+
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			addTestSessionCookie(t, srv, request, "secret")
+			token, id, err := srv.sessionToken(request)
+			if err != nil || token != "secret" {
+				t.Errorf("Expected session token: secret - Actual session token: %s (%v)", token, err)
+			}
+			if stored := srv.sessions[id].Token; (testCase.key != "") == bytes.Equal(stored, []byte("secret")) {
+				t.Errorf("Expected token to be held encrypted: %t - Actual held token: %q", testCase.key != "", stored)
+			}
+
+			// Sessions can't be used once expired
+			s := srv.sessions[id]
+			s.Expires = time.Now().Add(-time.Second)
+			srv.sessions[id] = s
+			if _, _, err := srv.sessionToken(request); err == nil {
+				t.Errorf("Expected error when using an expired session")
+			}
+			if _, ok := srv.sessions[id]; ok {
+				t.Errorf("Expected expired session to be removed")
+			}
+		})
+	}
+
+	t.Run("Unknown session", func(t *testing.T) {
+		srv, err := setupTestServer()
+		if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.AddCookie(&http.Cookie { Name: sessionCookie, Value: "guess" })
+		if _, _, err := srv.sessionToken(request); err == nil {
+			t.Errorf("Expected error when using an unknown session")
+		}
+	})
+
+	t.Run("Invalid key", func(t *testing.T) {
+		if _, err := loadSessionKey("c2hvcnQ="); err == nil {
+			t.Errorf("Expected error when providing a key of the wrong size")
+		}
+	})
+}
+
+func TestSessionCookie(t *testing.T) {
+	rr := httptest.NewRecorder()
+	setSessionCookie(rr, httptest.NewRequest(http.MethodGet, "https://localhost/", nil), "abc")
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected 1 cookie, actually received: %v", cookies)
+	}
+	if c := cookies[0]; c.Name != sessionCookie || c.Value != "abc" || !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("Expected HttpOnly, Secure, SameSite session cookie, actually received: %v", c)
+	}
+}
+
+func TestLogoutHandler(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+	github := setupTestGitHub(t, testGitHubData { "alice": {} })
+	srv.apiURL = github.URL
+
+	srv.jobCond.L.Lock()
+	srv.jobFor("alice").auth = "token-alice"
+	srv.jobCond.L.Unlock()
+
+	request := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	addTestSessionCookie(t, srv, request, "token-alice")
+	rr := httptest.NewRecorder()
+	srv.logoutHandler(rr, request)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("Expected status: %d - Actual status: %d", http.StatusSeeOther, rr.Code)
+	}
+	if len(srv.sessions) != 0 {
+		t.Errorf("Expected session to be ended")
+	}
+	if cookies := rr.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("Expected session cookie to be cleared, actually received: %v", cookies)
+	}
+	if resp, err := srv.request("token-alice", http.MethodGet, github.URL + "/user"); err != nil || resp.Status != http.StatusUnauthorized {
+		t.Errorf("Expected access token to be revoked, actually received status %d (%v)", resp.Status, err)
+	}
+	srv.jobCond.L.Lock()
+	if auth := srv.jobFor("alice").auth; auth != "" { t.Errorf("Expected background crawls to stop using the revoked token, actually using %s", auth) }
+	srv.jobCond.L.Unlock()
+}
@@ -0,0 +1,109 @@
+package webserver
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	"github.com/gorilla/websocket"
+)
+
+// How long shutdown waits for crawls to stop before the final cache write
+const defaultShutdownTimeout = 5 * time.Second
+
+// Registers the crawl on a WebSocket connection so shutdown can stop it, returning a function to call once it has
+// finished. Returns false if the server is already shutting down.
+func (srv *server) startCrawl(ws *wsConn, stop func()) (func(), bool) {
+	srv.crawlMutex.Lock()
+	defer srv.crawlMutex.Unlock()
+	if srv.shuttingDown { return nil, false }
+	srv.crawls[ws] = stop
+	srv.crawlGroup.Add(1)
+	return func() {
+		srv.crawlMutex.Lock()
+		delete(srv.crawls, ws)
+		srv.crawlMutex.Unlock()
+		srv.crawlGroup.Done()
+	}, true
+}
+
+// Stops every crawl and background job and sends the client of each crawl a close frame with the reason, all at once
+// so slow clients only hold shutdown up until the contexts deadline. No crawls start afterwards.
+func (srv *server) stopCrawls(ctx context.Context, reason string) {
+	srv.stopJobs()
+	srv.crawlMutex.Lock()
+	srv.shuttingDown = true
+	crawls := make(map[*wsConn]func(), len(srv.crawls))
+	for ws, stop := range srv.crawls { crawls[ws] = stop }
+	srv.crawlMutex.Unlock()
+
+	infof("Stopping %d crawls...", len(crawls))
+	deadline, ok := ctx.Deadline()
+	if !ok { deadline = time.Now().Add(time.Second) }
+	var wg sync.WaitGroup
+	wg.Add(len(crawls))
+	for ws, stop := range crawls {
+		go func(ws *wsConn, stop func()) {
+			defer wg.Done()
+			closeWebSocket(ws, reason, deadline)
+			stop()
+		}(ws, stop)
+	}
+	wg.Wait()
+}
+
+// Sends the client a close frame with the reason, giving up at the deadline
+func closeWebSocket(ws *wsConn, reason string, deadline time.Time) {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	ws.WriteControl(websocket.CloseMessage, msg, deadline)
+}
+
+// Waits for the stopped crawls to finish, returning false if the context ends first
+func (srv *server) waitForCrawls(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		srv.crawlGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Stops accepting connections, then stops the crawls and waits for them and any other requests to finish for up to
+// the timeout. WebSocket connections are hijacked, so http.Server.Shutdown doesn't wait for them by itself.
+// Returns false if anything was still running at the deadline.
+func (srv *server) shutdown(timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	srv.stopCrawls(ctx, "Server is shutting down")
+	if srv.redirect != nil { srv.redirect.Shutdown(ctx) }
+	err := srv.http.Shutdown(ctx)
+	if err != nil { warnf("Requests still running after %v: %v", timeout, err) }
+	if !srv.waitForCrawls(ctx) {
+		srv.crawlMutex.Lock()
+		warnf("%d crawls still running after %v, saving the cache anyway.", len(srv.crawls), timeout)
+		srv.crawlMutex.Unlock()
+		return false
+	}
+	return err == nil
+}
+
+// Shuts the server down on an interrupt or SIGTERM, which Docker sends, signalling done once it has
+func (srv *server) startSignalHandler(sigChan chan os.Signal, timeout time.Duration, done chan bool) {
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigChan
+	prefix := log.Prefix()
+	log.SetPrefix("[SHUTDOWN] ")
+	infof("Received %v, shutting down server...", sig)
+	srv.shutdown(timeout)
+	infof("Server shutdown.")
+	log.SetPrefix(prefix)
+	done <- true
+}
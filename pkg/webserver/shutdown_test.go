@@ -0,0 +1,84 @@
+package webserver
+
+import (
+	"testing"
+	"errors"
+	"time"
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdown(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	srv.apiURL = setupTestGitHub(t, testGitHubData {
+		"alice": { "foo": { "alice": 5, "bob": 1 } },
+		"bob": {},
+	}).URL
+
+	// Connect a paused and a running crawl
+	paused := dialTestWSHandler(t, srv, "token-alice")
+	running := dialTestWSHandler(t, srv, "token-alice")
+	if err := running.WriteJSON(map[string]string { "command": "continue" }); err != nil { t.Fatalf("Unable to send continue command: %v", err) }
+	var status statusFormat
+	readTestWSMessage(t, paused, "paused", &status)
+	readTestWSMessage(t, running, "paused", &status)
+
+	if !srv.shutdown(5 * time.Second) { t.Errorf("Expected crawls to stop before the deadline") }
+	if len(srv.crawls) != 0 { t.Errorf("Expected no crawls after shutdown, actually %d running", len(srv.crawls)) }
+
+	assertClosed := func(t *testing.T, ws *websocket.Conn) {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, _, err := ws.ReadMessage()
+			if err == nil { continue }
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway || closeErr.Text != "Server is shutting down" {
+				t.Errorf("Expected going away close frame, actually received: %v", err)
+			}
+			return
+		}
+	}
+	t.Run("Crawls", func(t *testing.T) {
+		assertClosed(t, paused)
+		assertClosed(t, running)
+	})
+	t.Run("New connection", func(t *testing.T) {
+		assertClosed(t, dialTestWSHandler(t, srv, "token-alice"))
+	})
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	ws, _ := setupTestWebSocket(t)
+
+	// A crawl stuck waiting on GitHub ignores being stopped
+	stopped := false
+	finished, ok := srv.startCrawl(&wsConn { Conn: ws }, func() { stopped = true })
+	if !ok { t.Fatalf("Expected crawl to start") }
+	defer finished()
+
+	start := time.Now()
+	if srv.shutdown(50 * time.Millisecond) { t.Errorf("Expected shutdown to report the crawl still running") }
+	if elapsed := time.Since(start); elapsed > time.Second { t.Errorf("Expected shutdown to give up after the deadline, actually took %v", elapsed) }
+	if !stopped { t.Errorf("Expected crawl to be told to stop") }
+	if _, ok := srv.startCrawl(&wsConn { Conn: ws }, func() {}); ok { t.Errorf("Expected no crawls to start during shutdown") }
+}
+
+func TestShutdownSlowClients(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+
+	// Clients in the middle of being written to hold up their close frames
+	for i := 0; i < 5; i++ {
+		ws, _ := setupTestWebSocket(t)
+		if _, err := ws.NextWriter(websocket.TextMessage); err != nil { t.Fatalf("Unable to start writing: %v", err) }
+		finished, ok := srv.startCrawl(&wsConn { Conn: ws }, func() {})
+		if !ok { t.Fatalf("Expected crawl to start") }
+		defer finished()
+	}
+
+	start := time.Now()
+	srv.shutdown(200 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second { t.Errorf("Expected close frames to be sent at once within the deadline, actually took %v", elapsed) }
+}
@@ -5,82 +5,221 @@ import (
 	"html/template"
 	"log"
 	"os"
-	"os/signal"
-	"context"
-	"errors"
 	"time"
 	"sync"
+	"strings"
+	"crypto/cipher"
+	"crypto/rand"
+	"container/list"
 	"github.com/gorilla/mux"
 )
 
+// GitHub.com endpoints, overridden for GitHub Enterprise Server or testing
+const (
+	defaultAPIURL = "https://api.github.com"
+	defaultOAuthURL = "https://github.com"
+)
+
+// Number of GitHub requests sent concurrently
+const defaultWorkers = 8
+
 type server struct {
 	http http.Server
+	redirect *http.Server // Redirects plain HTTP to HTTPS, if enabled
+	crawls map[*wsConn]func() // Stops the crawl on each WebSocket connection, guarded by crawlMutex
+	crawlMutex *sync.Mutex
+	crawlGroup *sync.WaitGroup
+	shuttingDown bool // Guarded by crawlMutex
+	jobs map[string]*crawlJob // Background crawls by root login, guarded by the job lock
+	pendingJobs []*crawlJob // Jobs waiting for a crawler in order, guarded by the job lock
+	jobCond *sync.Cond // Holds the job lock, broadcast whenever a job may be able to carry on
+	crawlers int // Most jobs run at once
+	crawlBackoff time.Duration // First wait before a job scans a user again after a failed scan
+	runningCrawlers int // Guarded by the job lock
+	jobsStopped bool // Guarded by the job lock
+	tokenPool []tokenSource // Tokens background crawls use instead of their subscribers
 	templates *template.Template
 	clientID, clientSecret string
+	apiURL, oauthURL string
 	requestCache map[string]requestCacheEntry
 	collabGraph map[string]userEntry
-	requestMutex *sync.Mutex
+	graphMutex *sync.RWMutex // Guards collabGraph, whose entries are replaced rather than modified
+	inflight map[string]*inflightRequest
+	requestMutex *sync.Mutex // Guards requestCache and inflight, never held during network I/O
+	rateLimits map[string]rateLimit
+	rateMutex *sync.Mutex
+	workers chan struct{} // Semaphore bounding concurrent GitHub requests
+	apiCalls uint64 // Number of requests sent to GitHub, updated atomically
+	sessions map[string]session
+	sessionMutex *sync.Mutex
+	usedStates map[string]time.Time // OAuth states of finished logins until they expire, guarded by sessionMutex
+	sessionCipher cipher.AEAD // Encrypts access tokens held in sessions, nil if no key is configured
+	stateKey []byte // Seals OAuth login states in their cookies
+	cacheSalt []byte // Salts the token hashes in request cache keys
+	store Store // Persists requestCache and collabGraph
+	dirtyRequests map[string]bool // Keys changed since the last save, guarded by requestMutex
+	dirtyUsers map[string]bool // Users changed since the last save, guarded by graphMutex
+	prefs map[string]crawlPrefs // Crawl preferences users saved, guarded by prefsMutex
+	prefsMutex *sync.Mutex
+	dirtyPrefs map[string]bool // Guarded by prefsMutex
+	frontiers map[string]*crawlFrontier // Where the crawl from each root user has got to, guarded by frontierMutex
+	frontierMutex *sync.Mutex
+	dirtyFrontiers map[string]bool // Guarded by frontierMutex
+	cacheLimits cacheLimits
+	requestLRU *list.List // Cached request keys, most recently used first, guarded by requestMutex
+	requestElements map[string]*list.Element // Guarded by requestMutex
+	requestBytes int64 // Estimated size of the cached requests, guarded by requestMutex
+	evictions evictionStats // Guarded by requestMutex
+	ttlPolicy ttlPolicy
+	expandTTL time.Duration // How long scanned collaborators are reused
+	offline bool // Only answer requests from the cache, however stale, never send them and never change the cache file
+	now func() time.Time // Clock for caching and rate limits, replaced in tests
 }
 
-func Start(address, public, templates, cache string) error {
+// Starts the server and blocks until it is shut down
+func Start(config Config) error {
+	setLogLevel(config.LogLevel)
+	prefix := log.Prefix()
+	defer log.SetPrefix(prefix)
 	log.SetPrefix("[SETUP] ")
-	log.Printf("Setting up server...")
+	infof("Setting up server...")
+	if err := config.validate(); err != nil { return err }
 
 	// Initialize server
-	var srv server
+	srv := newServer()
 	var err error
-	srv.requestMutex = &sync.Mutex{}
-	if srv.clientID, srv.clientSecret, err = loadSecrets(); err != nil { return err }
-	if srv.templates, err = loadTemplates(templates); err != nil { return err }
-	if srv.requestCache, srv.collabGraph, err = readCacheFromDisk(cache); err != nil { return err }
-	srv.setupHTTPServer(address, public)
+	if err = srv.configure(config); err != nil { return err }
+	if srv.templates, err = loadTemplates(config.Templates); err != nil { return err }
+	if err = srv.loadCache(config.Cache); err != nil { return err }
+	srv.setupHTTPServer(config.Listen, config.Public)
+	srv.setupTLS(config)
 
-	log.Printf(
-		"Loaded %d cached requests and %d users from cache.",
-		len(srv.requestCache), len(srv.collabGraph))
+	requests, bytes, evictions := srv.requestCacheStats()
+	infof(
+		"Loaded %d cached requests (%d bytes) and %d users from cache, evicted %v.",
+		requests, bytes, len(srv.collabGraph), evictions)
+	if config.Seeds != "" {
+		if err = srv.seedCrawls(config.Seeds, config.SeedDepth); err != nil { return err }
+	}
 
-	// Save cache every 30 seconds
+	// Save cache periodically
 	quitChan := make(chan bool, 1)
-	go srv.startCacheAutoWriter(cache, quitChan)
+	go srv.startCacheAutoWriter(config.Autosave, quitChan)
 
 	// Shutdown server after receiving a signal
 	sigChan := make(chan os.Signal, 1)
-	go srv.startSignalHandler(sigChan)
+	shutdownChan := make(chan bool, 1)
+	go srv.startSignalHandler(sigChan, config.ShutdownTimeout, shutdownChan)
 
 	// Start blocking HTTP server
-	log.Printf("Server is up and listening at %s", address)
-	log.SetPrefix("")
-	err = srv.http.ListenAndServe()
-	if err == http.ErrServerClosed { err = nil }
+	infof("Server is up and listening at %s", config.Listen)
+	log.SetPrefix(prefix)
+	if srv.redirect != nil {
+		go func() {
+			if err := srv.redirect.ListenAndServe(); err != http.ErrServerClosed { warnf("HTTPS redirect stopped: %v", err) }
+		}()
+	}
+	if config.TLSCert != "" {
+		err = srv.http.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+	} else {
+		err = srv.http.ListenAndServe()
+	}
 
-	// Wait for everything to stop
+	// Wait for the crawls to stop before the final cache write
+	if err == http.ErrServerClosed {
+		<-shutdownChan
+		err = nil
+	}
 	quitChan <- true
 	<-quitChan
-	log.Printf(
-		"Saved %d cached requests and %d users to cache.",
-		len(srv.requestCache), len(srv.collabGraph))
+	if closeErr := srv.store.Close(); closeErr != nil { warnf("Error while closing cache: %v", closeErr) }
 
 	return err
 }
 
-func loadSecrets() (string, string, error) {
-	log.Printf("Reading client secrets from environment variables...")
-	clientID := os.Getenv("GHO_CLIENT_ID")
-	clientSecret := os.Getenv("GHO_CLIENT_SECRET")
-	if clientID == "" || clientSecret == "" { return "", "", errors.New("Missing env vars") }
-	return clientID, clientSecret, nil
+func newServer() *server {
+	stateKey := make([]byte, 32)
+	cacheSalt := make([]byte, 32)
+	if _, err := rand.Read(stateKey); err != nil { panic(err) }
+	if _, err := rand.Read(cacheSalt); err != nil { panic(err) }
+	return &server {
+		apiURL: defaultAPIURL,
+		oauthURL: defaultOAuthURL,
+		requestCache: map[string]requestCacheEntry{},
+		collabGraph: map[string]userEntry{},
+		graphMutex: &sync.RWMutex{},
+		inflight: map[string]*inflightRequest{},
+		requestMutex: &sync.Mutex{},
+		rateLimits: map[string]rateLimit{},
+		rateMutex: &sync.Mutex{},
+		workers: make(chan struct{}, defaultWorkers),
+		sessions: map[string]session{},
+		sessionMutex: &sync.Mutex{},
+		usedStates: map[string]time.Time{},
+		stateKey: stateKey,
+		cacheSalt: cacheSalt,
+		dirtyRequests: map[string]bool{},
+		dirtyUsers: map[string]bool{},
+		prefs: map[string]crawlPrefs{},
+		prefsMutex: &sync.Mutex{},
+		dirtyPrefs: map[string]bool{},
+		frontiers: map[string]*crawlFrontier{},
+		frontierMutex: &sync.Mutex{},
+		dirtyFrontiers: map[string]bool{},
+		requestLRU: list.New(),
+		requestElements: map[string]*list.Element{},
+		crawls: map[*wsConn]func(){},
+		crawlMutex: &sync.Mutex{},
+		crawlGroup: &sync.WaitGroup{},
+		jobs: map[string]*crawlJob{},
+		jobCond: sync.NewCond(&sync.Mutex{}),
+		crawlers: defaultCrawlers,
+		crawlBackoff: defaultCrawlBackoff,
+		ttlPolicy: defaultTTLPolicy,
+		expandTTL: defaultExpandTTL,
+		now: time.Now,
+	}
+}
+
+// Applies the settings of the config to the server
+func (srv *server) configure(config Config) error {
+	var err error
+	srv.clientID, srv.clientSecret = config.ClientID, config.ClientSecret
+	srv.apiURL, srv.oauthURL = strings.TrimSuffix(config.APIURL, "/"), strings.TrimSuffix(config.OAuthURL, "/")
+	infof("Using GitHub API at %s and OAuth at %s", srv.apiURL, srv.oauthURL)
+	srv.workers = make(chan struct{}, config.Workers)
+	infof("Using %d workers for GitHub requests", config.Workers)
+	if srv.sessionCipher, err = loadSessionKey(config.SessionKey); err != nil { return err }
+	srv.cacheLimits = cacheLimits { config.CacheMaxEntries, config.CacheMaxBytes, config.CacheMaxAge }
+	infof("Limiting request cache to %d entries, %d bytes and %v old (0 is unlimited)", config.CacheMaxEntries, config.CacheMaxBytes, config.CacheMaxAge)
+	if srv.ttlPolicy, err = loadTTLPolicy(config.CacheTTLs, config.CacheHonourMaxAge); err != nil { return err }
+	srv.expandTTL = config.ExpandTTL
+	infof("Scanning users again after %v", srv.expandTTL)
+	srv.crawlers = config.Crawlers
+	infof("Running %d background crawls at once", srv.crawlers)
+	if err = srv.loadTokenPool(config.CrawlTokens, config.AppID, config.AppInstallation, config.AppKey); err != nil { return err }
+	return nil
+}
+
+func loadTTLPolicy(spec string, honourMaxAge bool) (ttlPolicy, error) {
+	policy, err := defaultTTLPolicy.with(spec)
+	if err != nil { return policy, err }
+	policy.HonourMaxAge = honourMaxAge
+	for _, rule := range policy.Rules { infof("Revalidating %s after %v", rule.Pattern, rule.TTL) }
+	infof("Revalidating anything else after %v (honouring Cache-Control max-age: %t)", policy.Default, policy.HonourMaxAge)
+	return policy, nil
 }
 
 func loadTemplates(pattern string) (*template.Template, error) {
-	log.Printf("Parsing HTML template files matching %s...", pattern)
+	infof("Parsing HTML template files matching %s...", pattern)
 	return template.ParseGlob(pattern)
 }
 
 func (srv *server) setupHTTPServer(address, public string) {
-	log.Printf("Registering HTTP routes...")
+	infof("Registering HTTP routes...")
 
-	hasGHOCookie := func(r *http.Request, rm *mux.RouteMatch) bool {
-		_, err := r.Cookie("gho")
+	hasSessionCookie := func(r *http.Request, rm *mux.RouteMatch) bool {
+		_, err := r.Cookie(sessionCookie)
 		return err == nil
 	}
 
@@ -89,38 +228,34 @@ func (srv *server) setupHTTPServer(address, public string) {
 	}
 
 	r := mux.NewRouter()
+	r.HandleFunc("/logout", srv.logoutHandler).Methods(http.MethodPost)
 	r.HandleFunc("/", srv.oauthHandler).Queries("code", "{code}")
-	r.HandleFunc("/", srv.wsHandler).MatcherFunc(hasGHOCookie).MatcherFunc(isWebSocketRequest)
-	r.HandleFunc("/", srv.userHandler).MatcherFunc(hasGHOCookie)
+	r.HandleFunc("/", srv.wsHandler).MatcherFunc(hasSessionCookie).MatcherFunc(isWebSocketRequest)
+	r.HandleFunc("/", srv.userHandler).MatcherFunc(hasSessionCookie)
 	r.HandleFunc("/", srv.unauthHandler)
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir(public)))
 	srv.http = http.Server { Addr: address, Handler: r }
 }
 
-func (srv *server) startCacheAutoWriter(cache string, quitChan chan bool) {
-	writeCache := func() {
-		err := writeCacheToDisk(cache, srv.requestCache, srv.collabGraph)
-		if err != nil { log.Printf("Warning - Error while writing to cache: %v", err) }
+func (srv *server) startCacheAutoWriter(interval time.Duration, quitChan chan bool) {
+	writeCache := func() (int, int) {
+		requests, users, err := srv.saveCache()
+		if err != nil { warnf("Error while writing to cache: %v", err) }
+		return requests, users
 	}
 
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
 		writeCache()
 		select {
 		case <-ticker.C:
 		case <-quitChan:
+			requests, users := writeCache()
+			_, bytes, evictions := srv.requestCacheStats()
+			infof("Saved %d cached requests (%d bytes) and %d users to cache, evicted %v.", requests, bytes, users, evictions)
 			quitChan <- true
 			return
 		}
 	}
 }
-
-func (srv *server) startSignalHandler(sigChan chan os.Signal) {
-	signal.Notify(sigChan, os.Interrupt)
-	<-sigChan
-	log.SetPrefix("[SHUTDOWN] ")
-	log.Printf("Shutting down server...")
-	srv.http.Shutdown(context.Background())
-	log.Printf("Server shutdown.")
-}
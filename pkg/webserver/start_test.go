@@ -7,6 +7,7 @@ import (
 	"syscall"
 	"time"
 	"fmt"
+	"io"
 )
 
 func TestStart(t *testing.T) {
@@ -35,11 +36,13 @@ func TestStart(t *testing.T) {
 		}()
 
 		// Run server wit provided config
-		err := Start(
-			address,
-			filepath.Join(dir, public),
-			filepath.Join(dir, templates),
-			filepath.Join(dir, cache))
+		config, err := LoadConfig("test", []string {
+			"--listen", address,
+			"--public", filepath.Join(dir, public),
+			"--templates", filepath.Join(dir, templates),
+			"--cache", filepath.Join(dir, cache),
+		}, io.Discard)
+		if err == nil { err = Start(config) }
 		ok = true
 		return err
 	}
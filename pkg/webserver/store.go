@@ -0,0 +1,129 @@
+package webserver
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Persists the request cache and collaboration graph as keys and values in named buckets
+type Store interface {
+	Get(bucket, key string) ([]byte, bool, error)
+	Put(bucket, key string, value []byte) error
+	Delete(bucket, key string) error
+	// Calls fn for every key in the bucket in order, stopping at the first error. fn must not use the store.
+	Iterate(bucket string, fn func(key string, value []byte) error) error
+	// Makes every change so far durable
+	Flush() error
+	Close() error
+}
+
+// Buckets of the servers store
+const (
+	requestsBucket = "requests"
+	usersBucket = "users"
+	prefsBucket = "prefs"
+	frontierBucket = "frontier"
+	metaBucket = "meta"
+)
+
+// Returned by changes to a store opened read-only
+var errReadOnlyStore = errors.New("The cache is open read-only")
+
+// Opens the store for the cache file, an append-only log if the file name ends in .log and a gzip-gob file otherwise.
+// Offline servers open it read-only, so they never change the file, e.g. while a running server is appending to it.
+func (srv *server) openStore(file string) (Store, error) {
+	if strings.HasSuffix(file, ".log") { return openLogStore(file, srv.offline) }
+	return openGobStore(file, srv.migrateCache, srv.offline)
+}
+
+// Holds every value in memory and rewrites the whole cache file when flushed
+type gobStore struct {
+	mutex sync.Mutex
+	flushMutex sync.Mutex // Keeps an older copy from being written over a newer one
+	file string
+	buckets map[string]map[string][]byte
+	dirty bool
+	readOnly bool
+}
+
+// Reads the gzip-gob cache file, upgrading it with migrate if it was written in an older format version.
+// A read-only store upgrades it in memory alone.
+func openGobStore(file string, migrate func(cache *diskCacheFormat, version int) error, readOnly bool) (*gobStore, error) {
+	cache, version, err := readCacheFromDisk(file)
+	if err == nil { err = migrate(&cache, version) }
+	if err != nil { return nil, err }
+	if cache.Buckets == nil { cache.Buckets = map[string]map[string][]byte{} }
+	return &gobStore { file: file, buckets: cache.Buckets, dirty: version != cacheVersion, readOnly: readOnly }, nil
+}
+
+func (s *gobStore) Get(bucket, key string) ([]byte, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok := s.buckets[bucket][key]
+	return value, ok, nil
+}
+
+func (s *gobStore) Put(bucket, key string, value []byte) error {
+	if s.readOnly { return errReadOnlyStore }
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.buckets[bucket] == nil { s.buckets[bucket] = map[string][]byte{} }
+	s.buckets[bucket][key] = value
+	s.dirty = true
+	return nil
+}
+
+func (s *gobStore) Delete(bucket, key string) error {
+	if s.readOnly { return errReadOnlyStore }
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.buckets[bucket][key]; !ok { return nil }
+	delete(s.buckets[bucket], key)
+	s.dirty = true
+	return nil
+}
+
+func (s *gobStore) Iterate(bucket string, fn func(key string, value []byte) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] { keys = append(keys, key) }
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, s.buckets[bucket][key]); err != nil { return err }
+	}
+	return nil
+}
+
+// Rewrites the cache file from a copy of the buckets, so the store can still be used while it's written
+func (s *gobStore) Flush() error {
+	if s.readOnly { return nil }
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+	s.mutex.Lock()
+	if !s.dirty {
+		s.mutex.Unlock()
+		return nil
+	}
+	buckets := make(map[string]map[string][]byte, len(s.buckets))
+	for name, bucket := range s.buckets {
+		buckets[name] = make(map[string][]byte, len(bucket))
+		for key, value := range bucket { buckets[name][key] = value }
+	}
+	s.dirty = false
+	s.mutex.Unlock()
+
+	err := writeCacheToDisk(s.file, diskCacheFormat { Buckets: buckets })
+	if err != nil {
+		s.mutex.Lock()
+		s.dirty = true
+		s.mutex.Unlock()
+	}
+	return err
+}
+
+func (s *gobStore) Close() error {
+	return s.Flush()
+}
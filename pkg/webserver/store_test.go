@@ -0,0 +1,57 @@
+package webserver
+
+import (
+	"testing"
+	"path/filepath"
+	"fmt"
+)
+
+func TestStores(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+
+	for _, name := range []string { "cache.gz", "cache.log" } {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), name)
+			store, err := srv.openStore(file)
+			if err != nil { t.Fatalf("Unable to open store: %v", err) }
+
+			for _, key := range []string { "c", "a", "b" } {
+				if err := store.Put("letters", key, []byte("old " + key)); err != nil { t.Fatalf("Unable to put %s: %v", key, err) }
+			}
+			store.Put("letters", "b", []byte("new b"))
+			store.Put("other", "a", []byte("other a"))
+			store.Delete("letters", "c")
+			store.Delete("letters", "missing")
+
+			assertStore := func(store Store) {
+				if value, ok, err := store.Get("letters", "b"); err != nil || !ok || string(value) != "new b" {
+					t.Errorf("Expected value: new b - Actual value: %s (%t, %v)", value, ok, err)
+				}
+				if _, ok, err := store.Get("letters", "c"); err != nil || ok {
+					t.Errorf("Expected deleted key to be missing (%v)", err)
+				}
+				var entries []string
+				err := store.Iterate("letters", func(key string, value []byte) error {
+					entries = append(entries, key + "=" + string(value))
+					return nil
+				})
+				if expected := "[a=old a b=new b]"; err != nil || fmt.Sprint(entries) != expected {
+					t.Errorf("Expected entries: %s - Actual entries: %v (%v)", expected, entries, err)
+				}
+			}
+			assertStore(store)
+
+			// Everything is kept once flushed and closed
+			if err := store.Flush(); err != nil { t.Fatalf("Unable to flush store: %v", err) }
+			if err := store.Close(); err != nil { t.Fatalf("Unable to close store: %v", err) }
+			store, err = srv.openStore(file)
+			if err != nil { t.Fatalf("Unable to reopen store: %v", err) }
+			defer store.Close()
+			assertStore(store)
+			if value, ok, _ := store.Get("other", "a"); !ok || string(value) != "other a" {
+				t.Errorf("Expected buckets to be kept apart, actually received: %s", value)
+			}
+		})
+	}
+}
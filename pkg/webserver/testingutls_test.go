@@ -7,7 +7,16 @@ import (
 	"net/http"
 	"strings"
 	"io"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
+	"net/url"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
 const loginHTML = `<p>login page!</p>`
@@ -15,16 +24,204 @@ const graphHTML = `<p>graph page!</p>`
 const errorHTML = `<p>error page!</p>`
 
 func setupTestServer() (*server, error) {
-	var srv server
-	var err error
-	if srv.clientID, srv.clientSecret, err = loadSecrets(); err != nil { return nil, err }
-	if srv.templates, err = template.New("login.html").Parse(loginHTML); err != nil { return &srv, err }
-	if srv.templates, err = srv.templates.New("graph.html").Parse(graphHTML); err != nil { return &srv, err }
-	if srv.templates, err = srv.templates.New("error.html").Parse(errorHTML); err != nil { return &srv, err }
-	srv.requestCache = map[string]requestCacheEntry{}
-	srv.collabGraph = map[string]userEntry{}
-	srv.requestMutex = &sync.Mutex{}
-	return &srv, nil
+	srv := newServer()
+	config, err := LoadConfig("test", nil, io.Discard)
+	if err != nil { return nil, err }
+	srv.clientID, srv.clientSecret = config.ClientID, config.ClientSecret
+	if srv.templates, err = template.New("login.html").Parse(loginHTML); err != nil { return srv, err }
+	if srv.templates, err = srv.templates.New("graph.html").Parse(graphHTML); err != nil { return srv, err }
+	if srv.templates, err = srv.templates.New("error.html").Parse(errorHTML); err != nil { return srv, err }
+	return srv, nil
+}
+
+// Small page size so fake GitHub lists are paginated
+const testMaxPerPage = 2
+
+// Fake GitHub data: owner -> repository -> contributor -> contributions
+type testGitHubData map[string]map[string]map[string]int
+
+// Starts a stand-in for the GitHub API and OAuth endpoints serving the provided data.
+// A user signs in through the authorize endpoint, exchanges the OAuth code "code-<login>" for the token "token-<login>",
+// authenticates with it and may revoke it.
+func setupTestGitHub(t *testing.T, data testGitHubData) *httptest.Server {
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+
+	// Paginate lists like GitHub, but with at most testMaxPerPage items per page
+	writePage := func(w http.ResponseWriter, r *http.Request, items []interface{}) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		if size <= 0 || size > testMaxPerPage { size = testMaxPerPage }
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page <= 0 { page = 1 }
+		start, end := (page - 1) * size, page * size
+		if start > len(items) { start = len(items) }
+		if end >= len(items) {
+			end = len(items)
+		} else {
+			next := *r.URL
+			query := next.Query()
+			query.Set("page", strconv.Itoa(page + 1))
+			next.RawQuery = query.Encode()
+			w.Header().Set("Link", `<http://` + r.Host + next.String() + `>; rel="next"`)
+		}
+		writeJSON(w, items[start:end])
+	}
+
+	revoked := map[string]bool{}
+	var revokedMutex sync.Mutex
+	isRevoked := func(token string) bool {
+		revokedMutex.Lock()
+		defer revokedMutex.Unlock()
+		return revoked[token]
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/applications/{client}/grant", func(w http.ResponseWriter, r *http.Request) {
+		var body struct { AccessToken string `json:"access_token"` }
+		if _, _, ok := r.BasicAuth(); !ok || json.NewDecoder(r.Body).Decode(&body) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		revokedMutex.Lock()
+		revoked[body.AccessToken] = true
+		revokedMutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodDelete)
+	// The "login" query parameter stands in for the user signing in to GitHub
+	challenges := map[string]string{}
+	var challengesMutex sync.Mutex
+	r.HandleFunc("/login/oauth/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("client_id") == "" || query.Get("code_challenge_method") != "S256" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		code := "code-" + query.Get("login")
+		challengesMutex.Lock()
+		challenges[code] = query.Get("code_challenge")
+		challengesMutex.Unlock()
+		http.Redirect(w, r, "/?" + url.Values { "code": { code }, "state": { query.Get("state") } }.Encode(), http.StatusFound)
+	})
+	r.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		code := r.URL.Query().Get("code")
+		verifier := sha256.Sum256([]byte(r.URL.Query().Get("code_verifier")))
+		challengesMutex.Lock()
+		challenge, ok := challenges[code]
+		delete(challenges, code)
+		challengesMutex.Unlock()
+		if !ok || challenge != base64.RawURLEncoding.EncodeToString(verifier[:]) {
+			w.Write([]byte("error=bad_verification_code"))
+			return
+		}
+		w.Write([]byte("access_token=token-" + strings.TrimPrefix(code, "code-") + "&token_type=bearer"))
+	}).Methods(http.MethodPost)
+	r.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		login := strings.TrimPrefix(r.Header.Get("Authorization"), "token token-")
+		if _, ok := data[login]; !ok || isRevoked("token-" + login) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, userFormat { Login: login })
+	})
+	r.HandleFunc("/users/{user}", func(w http.ResponseWriter, r *http.Request) {
+		login := mux.Vars(r)["user"]
+		if _, ok := data[login]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, userFormat { Login: login })
+	})
+	r.HandleFunc("/users/{user}/repos", func(w http.ResponseWriter, r *http.Request) {
+		login := mux.Vars(r)["user"]
+		repos, ok := data[login]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		names := make([]string, 0, len(repos))
+		for name := range repos { names = append(names, name) }
+		sort.Strings(names)
+		var body []interface{}
+		for _, name := range names {
+			body = append(body, repoFormat { Name: name, FullName: login + "/" + name, Owner: userFormat { Login: login } })
+		}
+		writePage(w, r, body)
+	})
+	r.HandleFunc("/repos/{owner}/{repo}/contributors", func(w http.ResponseWriter, r *http.Request) {
+		contributors, ok := data[mux.Vars(r)["owner"]][mux.Vars(r)["repo"]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		logins := make([]string, 0, len(contributors))
+		for login := range contributors { logins = append(logins, login) }
+		sort.Strings(logins)
+		sort.SliceStable(logins, func(i, j int) bool { return contributors[logins[i]] > contributors[logins[j]] })
+		var body []interface{}
+		for _, login := range logins {
+			body = append(body, userFormat { Login: login, Contributions: contributors[login] })
+		}
+		writePage(w, r, body)
+	})
+
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// Connects a WebSocket client to a WebSocket server, returning the server side and client side connections
+func setupTestWebSocket(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader websocket.Upgrader
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil { t.Errorf("WS upgrade error: %v", err) }
+		conns <- ws
+	}))
+	t.Cleanup(ts.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws" + strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil { t.Fatalf("Unable to dial test WebSocket server: %v", err) }
+	server := <-conns
+	t.Cleanup(func() { client.Close(); server.Close() })
+	return server, client
+}
+
+// Starts a session holding the token and adds its cookie to the request
+func addTestSessionCookie(t *testing.T, srv *server, r *http.Request, token string) {
+	id, err := srv.newSession(token)
+	if err != nil { t.Fatalf("Unable to start session: %v", err) }
+	r.AddCookie(&http.Cookie { Name: sessionCookie, Value: id })
+}
+
+// Opens a WebSocket connection to the servers wsHandler authenticated with the token
+func dialTestWSHandler(t *testing.T, srv *server, token string) *websocket.Conn {
+	ts := httptest.NewServer(http.HandlerFunc(srv.wsHandler))
+	t.Cleanup(ts.Close)
+	id, err := srv.newSession(token)
+	if err != nil { t.Fatalf("Unable to start session: %v", err) }
+	header := http.Header{}
+	header.Add("Cookie", (&http.Cookie { Name: sessionCookie, Value: id }).String())
+	ws, _, err := websocket.DefaultDialer.Dial("ws" + strings.TrimPrefix(ts.URL, "http"), header)
+	if err != nil { t.Fatalf("Unable to dial wsHandler: %v", err) }
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// Reads WebSocket messages until one with the given field arrives and decodes it into v
+func readTestWSMessage(t *testing.T, ws *websocket.Conn, field string, v interface{}) {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg map[string]json.RawMessage
+		if err := ws.ReadJSON(&msg); err != nil { t.Fatalf("Unable to read %s message: %v", field, err) }
+		if _, ok := msg[field]; ok {
+			buf, _ := json.Marshal(msg)
+			json.Unmarshal(buf, v)
+			return
+		}
+	}
 }
 
 func assertResponse(t *testing.T, r *http.Response, status int, body string) {
@@ -50,6 +247,21 @@ func assertWebserverResponse(t *testing.T, resp response, status int, body strin
 	}
 }
 
+// Signs in to the fake GitHub as the user and returns the request GitHub redirects the browser back with
+func startTestLogin(t *testing.T, srv *server, login string) *http.Request {
+	state, sealed, err := srv.newLoginState()
+	if err != nil { t.Fatalf("Unable to start login: %v", err) }
+	client := http.Client { CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse } }
+	resp, err := client.Get(srv.authorizeURL(state) + "&login=" + login)
+	if err != nil { t.Fatalf("Unable to authorize: %v", err) }
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound { t.Fatalf("Authorize returned %d", resp.StatusCode) }
+
+	request := httptest.NewRequest(http.MethodGet, resp.Header.Get("Location"), nil)
+	request.AddCookie(&http.Cookie { Name: stateCookie, Value: sealed })
+	return request
+}
+
 func assertResponseRecorder(t *testing.T, rr *httptest.ResponseRecorder, status int, body string) {
 	if rr.Code != status {
 		t.Errorf("Expected status: %d - Actual status: %d", status, rr.Code)
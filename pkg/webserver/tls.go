@@ -0,0 +1,64 @@
+package webserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Whether the request reached the server, or the proxy in front of it, over HTTPS
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// URL the page served for the request opens its WebSocket with, wss:// when the page came over HTTPS
+func webSocketURL(r *http.Request) string {
+	scheme := "ws"
+	if isHTTPS(r) { scheme = "wss" }
+	return scheme + "://" + r.Host + "/"
+}
+
+// Serves HTTPS with HTTP/2 when the config has a certificate, optionally with HSTS and a plain HTTP listener
+// redirecting to it. Must be called after setupHTTPServer.
+func (srv *server) setupTLS(config Config) {
+	if config.HSTS > 0 {
+		infof("Sending Strict-Transport-Security for %v over HTTPS", config.HSTS)
+		srv.http.Handler = hsts(config.HSTS, srv.http.Handler)
+	}
+	if config.TLSCert == "" { return }
+
+	// HTTP/2 is negotiated automatically, WebSockets keep using HTTP/1.1
+	infof("Serving HTTPS with certificate %s", config.TLSCert)
+	srv.http.TLSConfig = &tls.Config { MinVersion: tls.VersionTLS12 }
+	if config.HTTPSRedirect != "" {
+		infof("Redirecting plain HTTP at %s to HTTPS", config.HTTPSRedirect)
+		srv.redirect = &http.Server { Addr: config.HTTPSRedirect, Handler: httpsRedirect(config.Listen) }
+	}
+}
+
+// Adds Strict-Transport-Security to responses sent over HTTPS, so browsers stop using plain HTTP for the host
+func hsts(maxAge time.Duration, next http.Handler) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isHTTPS(r) { w.Header().Set("Strict-Transport-Security", value) }
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Redirects requests to the same URL on the HTTPS address, keeping their method
+func httpsRedirect(httpsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddress)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Trim(r.Host, "[]")
+		if h, _, err := net.SplitHostPort(r.Host); err == nil { host = h }
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://" + host + r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
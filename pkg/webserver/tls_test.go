@@ -0,0 +1,125 @@
+package webserver
+
+import (
+	"testing"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Writes a self-signed certificate for 127.0.0.1 and its key, returning their files
+func writeTestCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil { t.Fatalf("Unable to generate key: %v", err) }
+	template := &x509.Certificate {
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name { CommonName: "127.0.0.1" },
+		IPAddresses: []net.IP { net.ParseIP("127.0.0.1") },
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil { t.Fatalf("Unable to create certificate: %v", err) }
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil { t.Fatalf("Unable to marshal key: %v", err) }
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block { Type: "CERTIFICATE", Bytes: cert }), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block { Type: "EC PRIVATE KEY", Bytes: keyDER }), 0600)
+	return certFile, keyFile
+}
+
+func TestServeTLS(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+	certFile, keyFile := writeTestCertificate(t)
+	config := DefaultConfig()
+	config.Listen, config.TLSCert, config.TLSKey, config.HSTS = "127.0.0.1:0", certFile, keyFile, time.Hour
+	srv.setupHTTPServer(config.Listen, t.TempDir())
+	srv.setupTLS(config)
+
+	ln, err := net.Listen("tcp", config.Listen)
+	if err != nil { t.Fatalf("Unable to listen: %v", err) }
+	go srv.http.ServeTLS(ln, certFile, keyFile)
+	defer srv.http.Close()
+
+	client := &http.Client { Transport: &http.Transport {
+		TLSClientConfig: &tls.Config { InsecureSkipVerify: true },
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil { t.Fatalf("Request failed: %v", err) }
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK { t.Errorf("Expected status 200, actually received %d", resp.StatusCode) }
+	if resp.ProtoMajor != 2 { t.Errorf("Expected HTTP/2, actually received %s", resp.Proto) }
+	if hsts := resp.Header.Get("Strict-Transport-Security"); hsts != "max-age=3600" {
+		t.Errorf("Expected HSTS max-age=3600, actually received %q", hsts)
+	}
+	if c := resp.Cookies(); len(c) == 0 || !c[0].Secure { t.Errorf("Expected secure cookie over HTTPS, actually received %v", c) }
+}
+
+func TestHSTS(t *testing.T) {
+	handler := hsts(time.Hour, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	testCases := []struct {
+		name string
+		forwarded string
+		expected string
+	}{
+		{ "Plain HTTP", "", "" },
+		{ "Behind HTTPS proxy", "https", "max-age=3600" },
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			if testCase.forwarded != "" { request.Header.Set("X-Forwarded-Proto", testCase.forwarded) }
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if hsts := recorder.Header().Get("Strict-Transport-Security"); hsts != testCase.expected {
+				t.Errorf("Expected %q, actually received %q", testCase.expected, hsts)
+			}
+		})
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	testCases := []struct {
+		name string
+		address string
+		target string
+		expected string
+	}{
+		{ "Default port", ":443", "http://example.com/?code=1", "https://example.com/?code=1" },
+		{ "Other port", "127.0.0.1:8443", "http://example.com:8080/logout", "https://example.com:8443/logout" },
+		{ "IPv6", ":443", "http://[::1]:80/", "https://[::1]/" },
+		{ "IPv6 other port", ":8443", "http://[::1]/", "https://[::1]:8443/" },
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			httpsRedirect(testCase.address).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, testCase.target, nil))
+			if recorder.Code != http.StatusPermanentRedirect { t.Errorf("Expected status 308, actually received %d", recorder.Code) }
+			if location := recorder.Header().Get("Location"); location != testCase.expected {
+				t.Errorf("Expected redirect to %s, actually received %s", testCase.expected, location)
+			}
+		})
+	}
+}
+
+func TestWebSocketURL(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "http://example.com:8080/", nil)
+	if url := webSocketURL(request); url != "ws://example.com:8080/" { t.Errorf("Expected ws:// URL, actually received %s", url) }
+	request.Header.Set("X-Forwarded-Proto", "https")
+	if url := webSocketURL(request); url != "wss://example.com:8080/" { t.Errorf("Expected wss:// URL, actually received %s", url) }
+}
@@ -0,0 +1,157 @@
+package webserver
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"errors"
+	"strconv"
+	"strings"
+	"net/http"
+	"os"
+	"time"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+)
+
+// Supplies an auth token background crawls may use
+type tokenSource interface {
+	token() (string, error)
+}
+
+// A personal access token
+type staticToken string
+
+func (t staticToken) token() (string, error) { return string(t), nil }
+
+// How long before they expire GitHub App installation tokens are renewed
+const appTokenRenewal = 5 * time.Minute
+
+// Installation access tokens of a GitHub App, created as they're needed and renewed shortly before they expire
+type appTokenSource struct {
+	apiURL string
+	appID int64
+	installation int64
+	key *rsa.PrivateKey
+	now func() time.Time
+	mutex sync.Mutex
+	current string // Guarded by mutex
+	expires time.Time // Guarded by mutex
+}
+
+func (s *appTokenSource) token() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now()
+	if s.current != "" && now.Add(appTokenRenewal).Before(s.expires) { return s.current, nil }
+
+	jwt, err := s.jwt(now)
+	if err != nil { return "", err }
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", s.apiURL, s.installation)
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil { return "", err }
+	req.Header.Set("Authorization", "Bearer " + jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	var client http.Client
+	resp, err := client.Do(req)
+	if err != nil { return "", err }
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated { return "", fmt.Errorf("POST /app/installations/%d/access_tokens returned %d", s.installation, resp.StatusCode) }
+
+	var body struct {
+		Token string `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil { return "", err }
+	infof("Created GitHub App installation token expiring at %s", body.ExpiresAt.Format(time.RFC1123))
+	s.current, s.expires = body.Token, body.ExpiresAt
+	return s.current, nil
+}
+
+// Signs a JSON Web Token authenticating as the app, backdated a minute for clock drift
+func (s *appTokenSource) jwt(now time.Time) (string, error) {
+	encode := func(v interface{}) string {
+		buf, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(buf)
+	}
+	claims := map[string]interface{} {
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(s.appID, 10),
+	}
+	unsigned := encode(map[string]string { "alg": "RS256", "typ": "JWT" }) + "." + encode(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash[:])
+	if err != nil { return "", err }
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Reads the PEM encoded private key GitHub generates for an app
+func loadAppKey(file string) (*rsa.PrivateKey, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil { return nil, err }
+	block, _ := pem.Decode(buf)
+	if block == nil { return nil, fmt.Errorf("No PEM block in GitHub App key %s", file) }
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil { return key, nil }
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil { return nil, err }
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok { return nil, errors.New("The GitHub App key must be an RSA key") }
+	return key, nil
+}
+
+// Builds the token pool from a comma separated list of personal access tokens and a GitHub App installation
+func (srv *server) loadTokenPool(tokens string, appID, installation int64, appKey string) error {
+	srv.tokenPool = nil
+	for _, token := range strings.Split(tokens, ",") {
+		if token = strings.TrimSpace(token); token != "" { srv.tokenPool = append(srv.tokenPool, staticToken(token)) }
+	}
+	if appID != 0 {
+		key, err := loadAppKey(appKey)
+		if err != nil { return err }
+		srv.tokenPool = append(srv.tokenPool, &appTokenSource { apiURL: srv.apiURL, appID: appID, installation: installation, key: key, now: srv.now })
+		infof("Crawling in the background as GitHub App %d installation %d", appID, installation)
+	}
+	infof("Using %d tokens for background crawls", len(srv.tokenPool))
+	return nil
+}
+
+// Picks the token with the most budget left from the pool, or the fallback if the pool is empty. Tokens GitHub hasn't
+// reported a limit for yet are tried first. If every token is rate limited, returns when the first one resets instead.
+func (srv *server) crawlToken(fallback string) (string, time.Time) {
+	candidates := []string { fallback }
+	if len(srv.tokenPool) != 0 {
+		candidates = nil
+		for _, source := range srv.tokenPool {
+			token, err := source.token()
+			if err != nil {
+				warnf("Unable to get a token from the pool: %v", err)
+				continue
+			}
+			candidates = append(candidates, token)
+		}
+	}
+
+	now := srv.now()
+	best, bestRemaining := "", -1
+	var reset time.Time
+	for _, token := range candidates {
+		if until := srv.rateLimitedUntil(token, now); !until.IsZero() {
+			if reset.IsZero() || until.Before(reset) { reset = until }
+			continue
+		}
+		limit := srv.rateLimitFor(token)
+		remaining := limit.Remaining
+		if limit.Limit == 0 { remaining = math.MaxInt32 }
+		if remaining > bestRemaining { best, bestRemaining = token, remaining }
+	}
+	if bestRemaining >= 0 { return best, time.Time{} }
+	if reset.IsZero() { reset = now.Add(time.Minute) } // Every source failed
+	return "", reset
+}
@@ -0,0 +1,105 @@
+package webserver
+
+import (
+	"testing"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+func TestCrawlToken(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	now := time.Now()
+	srv.now = func() time.Time { return now }
+	srv.rateLimits = map[string]rateLimit {
+		"limited": { 5000, 0, now.Add(time.Hour) },
+		"soon": { 5000, 0, now.Add(time.Minute) },
+		"low": { 5000, 10, now.Add(time.Hour) },
+		"high": { 5000, 100, now.Add(time.Hour) },
+	}
+
+	testCases := []struct {
+		name string
+		pool string
+		token string
+		reset time.Time
+	}{
+		{ "Empty pool", "", "fallback", time.Time{} },
+		{ "Most remaining", "low,limited,high", "high", time.Time{} },
+		{ "Unknown first", "high,unknown", "unknown", time.Time{} },
+		{ "All limited", "limited, soon", "", now.Add(time.Minute) },
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if err := srv.loadTokenPool(testCase.pool, 0, 0, ""); err != nil { t.Fatalf("Unable to load token pool: %v", err) }
+			token, reset := srv.crawlToken("fallback")
+			if token != testCase.token || !reset.Equal(testCase.reset) {
+				t.Errorf("Expected %q until %v, actually received %q until %v", testCase.token, testCase.reset, token, reset)
+			}
+		})
+	}
+}
+
+func TestAppToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil { t.Fatalf("Unable to generate key: %v", err) }
+	keyFile := filepath.Join(t.TempDir(), "app.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block { Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key) })
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil { t.Fatalf("Unable to write key: %v", err) }
+
+	// Hands out installation tokens to JWTs signed by the app
+	now := time.Now()
+	var created []string
+	var createdMutex sync.Mutex
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		if r.Method != http.MethodPost || r.URL.Path != "/app/installations/7/access_tokens" || len(parts) != 3 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var body struct { Issuer string `json:"iss"` }
+		json.Unmarshal(claims, &body)
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature) != nil || body.Issuer != "42" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		createdMutex.Lock()
+		created = append(created, body.Issuer)
+		token := "installation-" + string(rune('0' + len(created)))
+		createdMutex.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{} { "token": token, "expires_at": now.Add(time.Hour).Format(time.RFC3339) })
+	}))
+	t.Cleanup(github.Close)
+
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Unable to setup HTTP test server: %v", err) }
+	clock := now
+	srv.apiURL, srv.now = github.URL, func() time.Time { return clock }
+	if err := srv.loadTokenPool("", 42, 7, keyFile); err != nil { t.Fatalf("Unable to load token pool: %v", err) }
+
+	// The token is reused until it's about to expire
+	for i, expected := range []string { "installation-1", "installation-1" } {
+		if token, _ := srv.crawlToken(""); token != expected { t.Errorf("Expected token %d to be %s, actually %s", i, expected, token) }
+	}
+	clock = now.Add(time.Hour - time.Minute)
+	if token, _ := srv.crawlToken(""); token != "installation-2" { t.Errorf("Expected token to be renewed, actually %s", token) }
+
+	if err := srv.loadTokenPool("", 42, 7, filepath.Join(t.TempDir(), "missing.pem")); err == nil { t.Errorf("Expected error loading a missing key") }
+}
@@ -0,0 +1,103 @@
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long responses from API paths matching the pattern are used before they are revalidated with GitHub.
+// Each {name} segment of the pattern matches any one segment of the path.
+type ttlRule struct {
+	Pattern string
+	TTL time.Duration
+}
+
+// Decides how long cached responses stay fresh
+type ttlPolicy struct {
+	Rules []ttlRule // The first matching rule applies
+	Default time.Duration // For paths no rule matches
+	HonourMaxAge bool // Use the max-age GitHub sends in Cache-Control instead when there is one
+}
+
+// Profiles rarely change, repositories come and go more often and contributors change with every push
+var defaultTTLPolicy = ttlPolicy {
+	Rules: []ttlRule {
+		{ "/users/{user}", 7 * 24 * time.Hour },
+		{ "/users/{user}/repos", 24 * time.Hour },
+		{ "/repos/{owner}/{repo}/contributors", 12 * time.Hour },
+		{ "/user", time.Hour },
+	},
+	Default: 24 * time.Hour,
+}
+
+func (rule ttlRule) matches(path string) bool {
+	patternSegments := strings.Split(strings.Trim(rule.Pattern, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternSegments) != len(pathSegments) { return false }
+	for i, segment := range patternSegments {
+		wildcard := strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+		if !wildcard && segment != pathSegments[i] { return false }
+	}
+	return true
+}
+
+// Finds how long the response to the API URL stays fresh
+func (srv *server) ttl(rawURL string, resp response) time.Duration {
+	if srv.ttlPolicy.HonourMaxAge {
+		if maxAge, ok := parseMaxAge(resp.Header); ok { return maxAge }
+	}
+	if !strings.HasPrefix(rawURL, srv.apiURL + "/") { return srv.ttlPolicy.Default }
+	u, err := url.Parse(strings.TrimPrefix(rawURL, srv.apiURL))
+	if err != nil { return srv.ttlPolicy.Default }
+	for _, rule := range srv.ttlPolicy.Rules {
+		if rule.matches(u.Path) { return rule.TTL }
+	}
+	return srv.ttlPolicy.Default
+}
+
+// Reads max-age from a Cache-Control header, e.g. "private, max-age=60, s-maxage=60". no-cache and no-store give 0.
+func parseMaxAge(header http.Header) (time.Duration, bool) {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value := strings.TrimSpace(directive), ""
+		if i := strings.Index(name, "="); i != -1 { name, value = name[:i], strings.Trim(name[i + 1:], `"`) }
+		switch strings.ToLower(name) {
+		case "no-cache", "no-store":
+			return 0, true
+		case "max-age":
+			seconds, err := strconv.Atoi(value)
+			if err == nil && seconds >= 0 { return time.Duration(seconds) * time.Second, true }
+		}
+	}
+	return 0, false
+}
+
+// Parses TTL rules from a comma separated list of pattern=duration, e.g. "/users/{user}=168h,default=24h".
+// The rules replace the policies rules with the same pattern and new patterns take priority, "default" sets the default TTL.
+func (p ttlPolicy) with(spec string) (ttlPolicy, error) {
+	rules := append([]ttlRule{}, p.Rules...)
+	added := []ttlRule{}
+	for _, field := range strings.Split(spec, ",") {
+		if strings.TrimSpace(field) == "" { continue }
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 { return p, fmt.Errorf("Invalid TTL rule: %s", field) }
+		pattern := strings.TrimSpace(parts[0])
+		ttl, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || ttl < 0 { return p, fmt.Errorf("Invalid TTL for %s: %s", pattern, parts[1]) }
+
+		if pattern == "default" {
+			p.Default = ttl
+			continue
+		}
+		replaced := false
+		for i := range rules {
+			if rules[i].Pattern == pattern { rules[i].TTL, replaced = ttl, true }
+		}
+		if !replaced { added = append(added, ttlRule { pattern, ttl }) }
+	}
+	p.Rules = append(added, rules...)
+	return p, nil
+}
@@ -0,0 +1,98 @@
+package webserver
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+)
+
+func TestTTLPolicy(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+	srv.apiURL = "https://api.example.com"
+
+	policy, err := defaultTTLPolicy.with("/users/{user}=1h, /users/torvalds=5m, default=2h")
+	if err != nil { t.Fatalf("Unable to parse TTLs: %v", err) }
+	srv.ttlPolicy = policy
+
+	maxAge := http.Header { "Cache-Control": { "private, max-age=60, s-maxage=60" } }
+	testCases := []struct { name string; url string; header http.Header; honourMaxAge bool; ttl time.Duration } {
+		{ "Profile", "/users/alice", nil, false, time.Hour },
+		{ "Overridden profile", "/users/torvalds", nil, false, 5 * time.Minute },
+		{ "Repositories", "/users/alice/repos?per_page=100&page=2", nil, false, 24 * time.Hour },
+		{ "Contributors", "/repos/alice/foo/contributors", nil, false, 12 * time.Hour },
+		{ "Authenticated user", "/user", nil, false, time.Hour },
+		{ "Unmatched path", "/users/alice/repos/extra", nil, false, 2 * time.Hour },
+		{ "Other host", "https://example.com/users/alice", nil, false, 2 * time.Hour },
+		{ "Ignoring max-age", "/users/alice", maxAge, false, time.Hour },
+		{ "Honouring max-age", "/users/alice", maxAge, true, time.Minute },
+		{ "Honouring no-cache", "/users/alice", http.Header { "Cache-Control": { "no-cache" } }, true, 0 },
+		{ "Honouring missing max-age", "/users/alice", nil, true, time.Hour },
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			srv.ttlPolicy.HonourMaxAge = testCase.honourMaxAge
+			url := testCase.url
+			if url[0] == '/' { url = srv.apiURL + url }
+			if ttl := srv.ttl(url, response { http.StatusOK, testCase.header, nil }); ttl != testCase.ttl {
+				t.Errorf("Expected TTL: %v - Actual TTL: %v", testCase.ttl, ttl)
+			}
+		})
+	}
+
+	if _, err := defaultTTLPolicy.with("/users/{user}=soon"); err == nil {
+		t.Errorf("Expected error when parsing an invalid TTL")
+	}
+}
+
+func TestRequestTTL(t *testing.T) {
+	srv, err := setupTestServer()
+	if err != nil { t.Fatalf("Failed to setup test server: %v", err) }
+
+	var calls, revalidations int32
+	testAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		if r.Header.Get("If-None-Match") == "xyz" {
+			atomic.AddInt32(&revalidations, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", "xyz")
+		w.Write([]byte("alice"))
+	}))
+	defer testAPIServer.Close()
+	srv.apiURL = testAPIServer.URL
+	srv.ttlPolicy = ttlPolicy { Rules: []ttlRule { { "/users/{user}", time.Hour } }, Default: time.Minute }
+
+	// Drive time forward through the servers clock
+	clock := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv.now = func() time.Time { return clock }
+
+	testCases := []struct { name string; advance time.Duration; honourMaxAge bool; calls int32; revalidations int32 } {
+		{ "First request", 0, false, 1, 0 },
+		{ "Fresh", 59 * time.Minute, false, 1, 0 },
+		{ "Stale", 2 * time.Minute, false, 2, 1 },
+		{ "Fresh after revalidation", 30 * time.Minute, false, 2, 1 },
+		{ "Stale by max-age", 2 * time.Minute, true, 3, 2 },
+		{ "Fresh by max-age", 30 * time.Second, true, 3, 2 },
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			clock = clock.Add(testCase.advance)
+			srv.ttlPolicy.HonourMaxAge = testCase.honourMaxAge
+			resp, err := srv.request("", http.MethodGet, testAPIServer.URL + "/users/alice")
+			if err != nil { t.Fatalf("An unexpected error occurred: %v", err) }
+			assertWebserverResponse(t, resp, http.StatusOK, "alice")
+			if calls != testCase.calls || revalidations != testCase.revalidations {
+				t.Errorf(
+					"Expected %d calls and %d revalidations - Actual %d calls and %d revalidations",
+					testCase.calls, testCase.revalidations, calls, revalidations)
+			}
+		})
+	}
+}
@@ -32,13 +32,20 @@ const pauseButton = document.getElementById("pause");
 const continueButton = document.getElementById("continue");
 const depthNumberText = document.getElementById("depth");
 const maxDepthNumberText = document.getElementById("maxdepth");
+const rateLimitText = document.getElementById("ratelimit");
 const statusText = document.getElementById("above-bottom-buttons");
+const targetInput = document.getElementById("target");
+const findButton = document.getElementById("find");
+const shortestButton = document.getElementById("shortest");
+const saveButton = document.getElementById("save");
+const refreshButton = document.getElementById("refresh");
+const targetPathText = document.getElementById("targetpath");
 
 window.onload = function () {
 
 	if (window["WebSocket"]) {
 
-		conn = new WebSocket("ws://" + document.location.host);
+		conn = new WebSocket(document.body.dataset.websocket);
 		conn.onmessage = function (evt) {
 			const data = JSON.parse(evt.data)
 			if (data.root !== undefined) {
@@ -53,22 +60,42 @@ window.onload = function () {
 				if (!data.paused) continueButton.style.background = "grey";
 				else              continueButton.style.background = "";
 				depthNumberText.innerHTML = data.depth
-				if (data.working) {
+				if (data.rate_limit > 0)
+					rateLimitText.innerHTML = data.rate_remaining + "/" + data.rate_limit
+				if (data.rate_limited) {
+					flashStatus = false
+					statusText.innerHTML = "Rate limited until " + new Date(data.rate_reset * 1000).toLocaleTimeString() + "..."
+				} else if (data.working) {
 					if (statusText.innerHTML !== "Wrapping up...") {
 						statusText.innerHTML = "Fetching user data..."
 						flashStatus = true
 					}
+				} else if (data.finished) {
+					flashStatus = false
+					statusText.innerHTML = "Everyone reachable has been found."
 				} else if (data.paused) {
 					flashStatus = false
 					statusText.innerHTML = "Searching paused."
 				} else {
 					statusText.innerHTML = ""
 				}
+			} else if (data.target !== undefined) {
+				let calls = data.calls ? " (" + data.calls + " API calls)" : ""
+				if (data.error)
+					targetPathText.innerText = "Search for " + data.target + " stopped: " + data.error + calls
+				else if (data.distance < 0)
+					targetPathText.innerText = "No path to " + data.target + " found" + calls
+				else
+					targetPathText.innerText = "Torvalds Number to " + data.target + ": " + data.distance + calls + "\n" +
+						pathText(data.path)
+				if (data.weighted)
+					targetPathText.innerText += "\nStrongest path (cost " + data.cost.toFixed(2) + "): " + pathText(data.weighted)
 			} else if (data.username !== undefined) {
 				graph[data.username] = data.collaborators
 				data.collaborators.forEach(c => {
 					c.avatar = new Image
 					c.avatar.src = c.avatar_url
+					c.via = data.via[c.login] || []
 				})
 			}
 		};
@@ -77,6 +104,21 @@ window.onload = function () {
 		minusButton.onclick = () => { if (--depth < 0) depth = 0; };
 		pauseButton.onclick = () => { statusText.innerHTML = "Wrapping up..."; conn.send(JSON.stringify({command:"pause"})); };
 		continueButton.onclick = () => { conn.send(JSON.stringify({command:"continue"})); };
+		findButton.onclick = () => {
+			targetPathText.innerText = "Searching for " + targetInput.value + "..."
+			conn.send(JSON.stringify({command:"target", login:targetInput.value.trim()}));
+		};
+		shortestButton.onclick = () => {
+			targetPathText.innerText = "Searching for the shortest path to " + targetInput.value + "..."
+			conn.send(JSON.stringify({command:"path", login:targetInput.value.trim()}));
+		};
+		refreshButton.onclick = () => {
+			conn.send(JSON.stringify({command:"refresh", login:targetInput.value.trim()}));
+		};
+		saveButton.onclick = () => {
+			statusText.innerHTML = "Saved search depth."
+			conn.send(JSON.stringify({command:"save"}));
+		};
 		document.addEventListener('keydown', (evt) => { keys[evt.keyCode] = true; })
 		document.addEventListener('keyup',   (evt) => { keys[evt.keyCode] = false; })
 		window.addEventListener('mousemove', mousecapture, false);
@@ -146,6 +188,12 @@ function drawPopup(parent, x, y, s, d, r) {
 		ctx.font = "20px helvetica";
 		ctx.fillText(parent.name || "", tx + 20, ty + 80, POPUP_WIDTH - 40);
 
+		if (parent.via && parent.via.length) {
+			ctx.font = "16px helvetica";
+			ctx.fillText("via " + viaText(parent.via), tx + 20, ty + 102, POPUP_WIDTH - 40);
+			ctx.font = "20px helvetica";
+		}
+
 		ctx.fillText(parent.location || "--", tx + 20, ty + 125, POPUP_WIDTH / 2 - 20);
 		ctx.fillText(parent.company || "--", tx + 20, ty + 150, POPUP_WIDTH / 2 - 20);
 		ctx.fillText(parent.email || "--", tx + POPUP_WIDTH / 2 + 10, ty + 125, POPUP_WIDTH / 2 - 20);
@@ -232,6 +280,14 @@ function toggleStatusText() {
 		statusText.style.display = "none"
 }
 
+function pathText(path) {
+	return path.map(hop => hop.via.length ? "→ " + hop.login + " (via " + viaText(hop.via) + ")" : hop.login).join(" ")
+}
+
+function viaText(via) {
+	return via.map(v => v.repo + " (" + v.contributions + " commits)").join(", ")
+}
+
 function timeSince(date) {
 	var seconds = Math.floor((new Date() - date) / 1000);
 	var interval = seconds / 31536000;